@@ -0,0 +1,279 @@
+package benchmark
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Producer and consumer on different hosts compare timestamps of two clocks.
+// The consumer answers NTP-style time requests on a side TCP socket, the
+// producer measures the consumer clock against its own and passes the
+// estimate on to the consumers in FlagControl messages through the broker.
+// Consumers correct the times of that producer's messages with it.
+//
+// A time request is the producer send time t1, the reply repeats t1 and adds
+// the consumer receive time t2 and reply time t3, all unix nanoseconds. With
+// t4 the producer receive time:
+//
+//	offset = ((t2 - t1) + (t3 - t4)) / 2
+//	delay  = (t4 - t1) - (t3 - t2)
+//
+// The true offset lies within delay/2 of the estimate, whatever the path
+// asymmetry, so of several exchanges the one with the shortest delay wins.
+//
+// A producer measures the clock of one consumer host, CLOCK_SYNC_SERVER, yet
+// every consumer of the topic gets the estimate. Consumers on other hosts
+// must keep their clocks close to that one, or their latencies are off by
+// the difference.
+
+// ClockEstimate is the offset of the consumer clock against a producer clock.
+type ClockEstimate struct {
+	// Reference is the producer time of the measurement, unix nanoseconds.
+	Reference int64 `json:"reference_ns"`
+	// Offset is consumer time minus producer time at Reference.
+	Offset int64 `json:"offset_ns"`
+	// Drift is how fast the offset changes, in nanoseconds per second
+	// (parts per million is Drift/1000).
+	Drift float64 `json:"drift_ns_per_s"`
+	// Uncertainty bounds the error of Offset at Reference.
+	Uncertainty int64 `json:"uncertainty_ns"`
+	Samples     int   `json:"samples"`
+}
+
+// offsetAt extrapolates the offset to the producer time t.
+func (estimate ClockEstimate) offsetAt(t int64) int64 {
+	return estimate.Offset + int64(estimate.Drift*float64(t-estimate.Reference)/float64(time.Second))
+}
+
+func (estimate ClockEstimate) String() string {
+	return fmt.Sprintf("offset %f ms +/- %f ms, drift %f ppm (%d exchanges)",
+		float64(estimate.Offset)/1000000.0, float64(estimate.Uncertainty)/1000000.0,
+		estimate.Drift/1000.0, estimate.Samples)
+}
+
+// Control message payloads start with their kind.
+const controlClockEstimate uint8 = 1
+
+const clockEstimateSize = 37
+
+var ErrBadControlMessage = errors.New("bad control message")
+
+func (estimate ClockEstimate) encode() []byte {
+	payload := make([]byte, clockEstimateSize)
+	payload[0] = controlClockEstimate
+	binary.BigEndian.PutUint64(payload[1:9], uint64(estimate.Reference))
+	binary.BigEndian.PutUint64(payload[9:17], uint64(estimate.Offset))
+	binary.BigEndian.PutUint64(payload[17:25], math.Float64bits(estimate.Drift))
+	binary.BigEndian.PutUint64(payload[25:33], uint64(estimate.Uncertainty))
+	binary.BigEndian.PutUint32(payload[33:37], uint32(estimate.Samples))
+	return payload
+}
+
+func decodeClockEstimate(payload []byte) (ClockEstimate, error) {
+	if len(payload) < clockEstimateSize || payload[0] != controlClockEstimate {
+		return ClockEstimate{}, ErrBadControlMessage
+	}
+	return ClockEstimate{
+		Reference:   int64(binary.BigEndian.Uint64(payload[1:9])),
+		Offset:      int64(binary.BigEndian.Uint64(payload[9:17])),
+		Drift:       math.Float64frombits(binary.BigEndian.Uint64(payload[17:25])),
+		Uncertainty: int64(binary.BigEndian.Uint64(payload[25:33])),
+		Samples:     int(binary.BigEndian.Uint32(payload[33:37])),
+	}, nil
+}
+
+// ServeClockSync answers time requests on addr in the background until the
+// returned listener is closed. An empty addr does nothing and returns nil.
+func ServeClockSync(addr string) (net.Listener, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot serve clock sync: %s", err)
+	}
+	log.Printf("Serving clock sync on %s", listener.Addr())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("[ERROR] Clock sync stopped: %s", err)
+				}
+				return
+			}
+			go serveClockSync(conn)
+		}
+	}()
+	return listener, nil
+}
+
+func serveClockSync(conn net.Conn) {
+	defer conn.Close()
+	request := make([]byte, 8)
+	reply := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		received := time.Now().UnixNano()
+		copy(reply[0:8], request)
+		binary.BigEndian.PutUint64(reply[8:16], uint64(received))
+		binary.BigEndian.PutUint64(reply[16:24], uint64(time.Now().UnixNano()))
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// clockSample is one exchange, or the best of a round of them.
+type clockSample struct {
+	time   int64
+	offset int64
+	delay  int64
+}
+
+// newClockSample works out offset and delay of an exchange from its four
+// timestamps, the sample time is the midpoint on the producer clock.
+func newClockSample(t1, t2, t3, t4 int64) clockSample {
+	return clockSample{
+		time:   t1 + (t4-t1)/2,
+		offset: ((t2 - t1) + (t3 - t4)) / 2,
+		delay:  (t4 - t1) - (t3 - t2),
+	}
+}
+
+// newClockEstimate turns the best sample of a round into an estimate, with
+// the drift since the first round.
+func newClockEstimate(first, best clockSample, samples int) ClockEstimate {
+	estimate := ClockEstimate{
+		Reference:   best.time,
+		Offset:      best.offset,
+		Uncertainty: best.delay / 2,
+		Samples:     samples,
+	}
+	if elapsed := best.time - first.time; elapsed > 0 {
+		estimate.Drift = float64(best.offset-first.offset) / (float64(elapsed) / float64(time.Second))
+	}
+	return estimate
+}
+
+// clockSync keeps the clock estimate of a producer up to date and sends it to
+// the consumers.
+type clockSync struct {
+	endpoint *SendEndpoint
+	conn     net.Conn
+	samples  int
+	first    *clockSample
+	estimate ClockEstimate
+	done     chan bool
+	stopped  chan bool
+	lock     sync.Mutex
+}
+
+// startClockSync measures the clock of the server at addr with samples
+// exchanges, sends the estimate, and does it again every interval until
+// stop. A zero interval measures only once.
+func startClockSync(endpoint *SendEndpoint, addr string, samples int, interval time.Duration) (*clockSync, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to clock sync server: %s", err)
+	}
+	if samples < 1 {
+		samples = 1
+	}
+	clock := &clockSync{
+		endpoint: endpoint,
+		conn:     conn,
+		samples:  samples,
+		done:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	if err := clock.update(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Printf("Consumer clock: %s", clock.Estimate())
+
+	go func() {
+		defer close(clock.stopped)
+		if interval <= 0 {
+			<-clock.done
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := clock.update(); err != nil {
+					log.Printf("[ERROR] Clock sync failed, keeping the last estimate: %s", err)
+				}
+			case <-clock.done:
+				return
+			}
+		}
+	}()
+	return clock, nil
+}
+
+// update measures the offset, works out the drift since the first round and
+// sends the estimate.
+func (clock *clockSync) update() error {
+	clock.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var best *clockSample
+	request := make([]byte, 8)
+	reply := make([]byte, 24)
+	for i := 0; i < clock.samples; i++ {
+		t1 := time.Now().UnixNano()
+		binary.BigEndian.PutUint64(request, uint64(t1))
+		if _, err := clock.conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(clock.conn, reply); err != nil {
+			return err
+		}
+		t4 := time.Now().UnixNano()
+		if int64(binary.BigEndian.Uint64(reply[0:8])) != t1 {
+			return fmt.Errorf("clock sync reply out of order")
+		}
+		t2 := int64(binary.BigEndian.Uint64(reply[8:16]))
+		t3 := int64(binary.BigEndian.Uint64(reply[16:24]))
+		sample := newClockSample(t1, t2, t3, t4)
+		if best == nil || sample.delay < best.delay {
+			best = &sample
+		}
+	}
+
+	clock.lock.Lock()
+	if clock.first == nil {
+		clock.first = best
+	}
+	estimate := newClockEstimate(*clock.first, *best, clock.estimate.Samples+clock.samples)
+	clock.estimate = estimate
+	clock.lock.Unlock()
+
+	clock.endpoint.sendControl(estimate.encode())
+	return nil
+}
+
+func (clock *clockSync) Estimate() ClockEstimate {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.estimate
+}
+
+// stop ends the updates and returns the last estimate.
+func (clock *clockSync) stop() ClockEstimate {
+	close(clock.done)
+	<-clock.stopped
+	clock.conn.Close()
+	return clock.Estimate()
+}
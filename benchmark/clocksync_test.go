@@ -0,0 +1,145 @@
+package benchmark
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClockSample(t *testing.T) {
+	tests := []struct {
+		name           string
+		t1, t2, t3, t4 int64
+		want           clockSample
+	}{
+		// Consumer 500 ahead, 100 each way, 20 to answer.
+		{"symmetric", 1000, 1600, 1620, 1220, clockSample{time: 1110, offset: 500, delay: 200}},
+		// Consumer 300 behind.
+		{"behind", 1000, 800, 810, 1210, clockSample{time: 1105, offset: -300, delay: 200}},
+		// 50 out and 150 back to a clock in step: half the asymmetry shows up in
+		// the offset, which stays within delay/2.
+		{"asymmetric", 1000, 1050, 1050, 1200, clockSample{time: 1100, offset: -50, delay: 200}},
+		{"same clock", 1000, 1000, 1000, 1000, clockSample{time: 1000, offset: 0, delay: 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := newClockSample(test.t1, test.t2, test.t3, test.t4); got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClockEstimateDrift(t *testing.T) {
+	first := clockSample{time: 0, offset: 1000, delay: 400}
+	// 10 seconds later the consumer clock has gained 500us: 50us per second, 50 ppm.
+	later := clockSample{time: int64(10 * time.Second), offset: 1000 + 500000, delay: 200}
+
+	estimate := newClockEstimate(first, later, 16)
+	want := ClockEstimate{Reference: later.time, Offset: later.offset, Drift: 50000, Uncertainty: 100, Samples: 16}
+	if estimate != want {
+		t.Errorf("got %+v, want %+v", estimate, want)
+	}
+	if got := estimate.offsetAt(later.time + int64(2*time.Second)); got != later.offset+100000 {
+		t.Errorf("offset 2s after the estimate %d, want %d", got, later.offset+100000)
+	}
+
+	// The first round has nothing to measure drift against.
+	if estimate := newClockEstimate(first, first, 8); estimate.Drift != 0 || estimate.offsetAt(int64(time.Hour)) != first.offset {
+		t.Errorf("first estimate %+v has drift", estimate)
+	}
+}
+
+func TestClockEstimateEncoding(t *testing.T) {
+	estimates := []ClockEstimate{
+		{},
+		{Reference: 1600000000123456789, Offset: -1234567, Drift: -12.5, Uncertainty: 4200, Samples: 24},
+		{Reference: math.MaxInt64, Offset: math.MinInt64, Drift: math.MaxFloat64, Uncertainty: math.MaxInt64, Samples: math.MaxUint32},
+	}
+	for _, estimate := range estimates {
+		decoded, err := decodeClockEstimate(estimate.encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != estimate {
+			t.Errorf("decoded %+v, want %+v", decoded, estimate)
+		}
+	}
+
+	payload := ClockEstimate{}.encode()
+	for name, bad := range map[string][]byte{
+		"empty":        nil,
+		"short":        payload[:clockEstimateSize-1],
+		"unknown kind": append([]byte{99}, payload[1:]...),
+	} {
+		if _, err := decodeClockEstimate(bad); err != ErrBadControlMessage {
+			t.Errorf("%s: got %v, want %v", name, err, ErrBadControlMessage)
+		}
+	}
+}
+
+func TestClockSync(t *testing.T) {
+	listener, err := ServeClockSync("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &recordingSender{}
+	clock, err := startClockSync(NewSendEndpoint(sender, 5), listener.Addr().String(), 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimate := clock.stop()
+
+	// Both ends read the same clock.
+	if estimate.Samples != 4 || estimate.Offset > estimate.Uncertainty || -estimate.Offset > estimate.Uncertainty {
+		t.Errorf("estimate %s, want 4 samples and no offset beyond the uncertainty", estimate)
+	}
+	if len(sender.headers) != 1 || !sender.headers[0].Has(FlagControl) || sender.headers[0].ProducerID != 5 {
+		t.Fatalf("sent %v, want one control message", sender.headers)
+	}
+
+	listener.Close()
+	if _, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second); err == nil {
+		t.Error("clock sync still served after close")
+	}
+	if _, err := startClockSync(NewSendEndpoint(sender, 5), listener.Addr().String(), 4, 0); err == nil {
+		t.Error("clock sync without a server succeeded")
+	}
+}
+
+func TestClockCorrection(t *testing.T) {
+	t.Setenv("CLOCK_SYNC_LISTEN", ":0")
+	t.Setenv("REPORT_INTERVAL_MS", "0")
+	handler := NewAllInOneMessageHandler(0, 0)
+	receive := func(producer uint32, sequence uint64, flags uint8, payload []byte) {
+		message := make([]byte, HeaderSize+len(payload))
+		copy(message[HeaderSize:], payload)
+		Header{ProducerID: producer, Sequence: sequence, Flags: flags, SendTime: time.Now().UnixNano()}.Encode(message)
+		handler.ReceiveMessage(message)
+	}
+
+	newer := ClockEstimate{Reference: 2000, Offset: 10, Samples: 16}
+	older := ClockEstimate{Reference: 1000, Offset: 20, Samples: 8}
+	receive(1, 1, 0, nil)
+	receive(1, 0, FlagControl, newer.encode())
+	receive(1, 0, FlagControl, older.encode())
+	receive(1, 2, 0, nil)
+	receive(2, 1, 0, nil)
+	receive(1, 2, FlagFin, nil)
+
+	result := handler.Result()
+	if result.Clocks[1] != newer {
+		t.Errorf("clock of producer 1 %+v, want the newer estimate %+v", result.Clocks[1], newer)
+	}
+	if result.ClockIgnored != 1 {
+		t.Errorf("%d estimates ignored, want the older one", result.ClockIgnored)
+	}
+	// Before the estimate from producer 1 and everything from producer 2.
+	if result.ClockUncorrected != 2 {
+		t.Errorf("%d messages uncorrected, want 2", result.ClockUncorrected)
+	}
+	if len(result.ClockMissing) != 1 || result.ClockMissing[0] != 2 {
+		t.Errorf("missing clocks of %v, want producer 2", result.ClockMissing)
+	}
+}
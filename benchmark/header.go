@@ -0,0 +1,138 @@
+package benchmark
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Every benchmark message starts with a fixed-layout header followed by the
+// payload. Integers are big endian.
+//
+//	offset  size  field
+//	0       2     magic 0x4d51 ("MQ")
+//	2       1     version
+//	3       1     flags
+//	4       4     producer ID
+//	8       8     sequence number
+//	16      8     send time, unix nanoseconds
+//	24      4     payload length
+//	28      8     intended send time, unix nanoseconds (version 2)
+//	36            payload
+//
+// Version 1 headers end at offset 28, their intended send time is taken to
+// be the send time.
+const (
+	HeaderMagic   uint16 = 0x4d51
+	HeaderVersion uint8  = 2
+	HeaderSize           = 36
+
+	headerSizeV1 = 28
+)
+
+// Header flags.
+const (
+	// FlagFin marks the end of a test. FIN messages carry the sequence number
+	// of the last data message instead of one of their own.
+	FlagFin uint8 = 1 << iota
+	// FlagWarmup messages go through the broker but are left out of results.
+	FlagWarmup
+	// FlagControl messages carry harness data rather than benchmark load.
+	FlagControl
+)
+
+var (
+	ErrShortMessage       = errors.New("message shorter than header")
+	ErrBadMagic           = errors.New("bad header magic")
+	ErrUnsupportedVersion = errors.New("unsupported header version")
+	ErrTruncatedPayload   = errors.New("payload shorter than header length")
+)
+
+type Header struct {
+	Version       uint8
+	Flags         uint8
+	ProducerID    uint32
+	Sequence      uint64
+	SendTime      int64
+	PayloadLength uint32
+	// IntendedTime is when the rate schedule wanted the message sent. The
+	// difference to SendTime is time the producer spent behind schedule.
+	IntendedTime int64
+}
+
+func (h Header) Has(flag uint8) bool {
+	return h.Flags&flag != 0
+}
+
+func (h Header) String() string {
+	return fmt.Sprintf("v%d producer=%d seq=%d flags=%#x sent=%d intended=%d payload=%d",
+		h.Version, h.ProducerID, h.Sequence, h.Flags, h.SendTime, h.IntendedTime, h.PayloadLength)
+}
+
+// Encode writes the header into the first HeaderSize bytes of message. It
+// always writes HeaderVersion, and everything after the header is payload.
+func (h Header) Encode(message []byte) error {
+	if len(message) < HeaderSize {
+		return ErrShortMessage
+	}
+	binary.BigEndian.PutUint16(message[0:2], HeaderMagic)
+	message[2] = HeaderVersion
+	message[3] = h.Flags
+	binary.BigEndian.PutUint32(message[4:8], h.ProducerID)
+	binary.BigEndian.PutUint64(message[8:16], h.Sequence)
+	binary.BigEndian.PutUint64(message[16:24], uint64(h.SendTime))
+	binary.BigEndian.PutUint32(message[24:28], uint32(len(message)-HeaderSize))
+	binary.BigEndian.PutUint64(message[28:36], uint64(h.IntendedTime))
+	return nil
+}
+
+func headerSize(version uint8) int {
+	if version == 1 {
+		return headerSizeV1
+	}
+	return HeaderSize
+}
+
+func DecodeHeader(message []byte) (Header, error) {
+	if len(message) < headerSizeV1 {
+		return Header{}, ErrShortMessage
+	}
+	if binary.BigEndian.Uint16(message[0:2]) != HeaderMagic {
+		return Header{}, ErrBadMagic
+	}
+	h := Header{
+		Version:       message[2],
+		Flags:         message[3],
+		ProducerID:    binary.BigEndian.Uint32(message[4:8]),
+		Sequence:      binary.BigEndian.Uint64(message[8:16]),
+		SendTime:      int64(binary.BigEndian.Uint64(message[16:24])),
+		PayloadLength: binary.BigEndian.Uint32(message[24:28]),
+	}
+	switch h.Version {
+	case 1:
+		h.IntendedTime = h.SendTime
+	case HeaderVersion:
+		if len(message) < HeaderSize {
+			return h, ErrShortMessage
+		}
+		h.IntendedTime = int64(binary.BigEndian.Uint64(message[28:36]))
+	default:
+		return h, ErrUnsupportedVersion
+	}
+	if uint64(len(message)-headerSize(h.Version)) < uint64(h.PayloadLength) {
+		return h, ErrTruncatedPayload
+	}
+	return h, nil
+}
+
+// Payload returns the bytes following the header.
+func Payload(message []byte) []byte {
+	if len(message) < headerSizeV1 {
+		return nil
+	}
+	size := headerSize(message[2])
+	if len(message) < size {
+		return nil
+	}
+	return message[size:]
+}
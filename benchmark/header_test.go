@@ -0,0 +1,150 @@
+package benchmark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// encodeV1 writes a version 1 header the way older producers did.
+func encodeV1(h Header, payload []byte) []byte {
+	message := make([]byte, headerSizeV1+len(payload))
+	binary.BigEndian.PutUint16(message[0:2], HeaderMagic)
+	message[2] = 1
+	message[3] = h.Flags
+	binary.BigEndian.PutUint32(message[4:8], h.ProducerID)
+	binary.BigEndian.PutUint64(message[8:16], h.Sequence)
+	binary.BigEndian.PutUint64(message[16:24], uint64(h.SendTime))
+	binary.BigEndian.PutUint32(message[24:28], uint32(len(payload)))
+	copy(message[headerSizeV1:], payload)
+	return message
+}
+
+func encodeV2(t *testing.T, h Header, payload []byte) []byte {
+	t.Helper()
+	message := make([]byte, HeaderSize+len(payload))
+	copy(message[HeaderSize:], payload)
+	if err := h.Encode(message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestHeaderRoundtrip(t *testing.T) {
+	sent := Header{
+		Flags:        FlagFin | FlagWarmup,
+		ProducerID:   42,
+		Sequence:     1 << 40,
+		SendTime:     1600000000123456789,
+		IntendedTime: 1600000000000000000,
+	}
+	payload := []byte("payload")
+
+	tests := []struct {
+		name    string
+		message []byte
+		want    Header
+	}{
+		{
+			name:    "v2",
+			message: encodeV2(t, sent, payload),
+			want: Header{
+				Version:       2,
+				Flags:         sent.Flags,
+				ProducerID:    sent.ProducerID,
+				Sequence:      sent.Sequence,
+				SendTime:      sent.SendTime,
+				PayloadLength: uint32(len(payload)),
+				IntendedTime:  sent.IntendedTime,
+			},
+		},
+		{
+			// Version 1 has no intended send time, it falls back to the send time.
+			name:    "v1",
+			message: encodeV1(sent, payload),
+			want: Header{
+				Version:       1,
+				Flags:         sent.Flags,
+				ProducerID:    sent.ProducerID,
+				Sequence:      sent.Sequence,
+				SendTime:      sent.SendTime,
+				PayloadLength: uint32(len(payload)),
+				IntendedTime:  sent.SendTime,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodeHeader(test.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("decoded %s, want %s", got, test.want)
+			}
+			if !bytes.Equal(Payload(test.message), payload) {
+				t.Errorf("payload %q, want %q", Payload(test.message), payload)
+			}
+		})
+	}
+}
+
+func TestEncodeHeaderShortMessage(t *testing.T) {
+	if err := (Header{}).Encode(make([]byte, HeaderSize-1)); err != ErrShortMessage {
+		t.Errorf("got %v, want %v", err, ErrShortMessage)
+	}
+}
+
+func TestDecodeHeaderErrors(t *testing.T) {
+	v2 := encodeV2(t, Header{Sequence: 1}, []byte("payload"))
+	v1 := encodeV1(Header{Sequence: 1}, []byte("payload"))
+	corrupt := func(message []byte, offset int, value byte) []byte {
+		message = append([]byte(nil), message...)
+		message[offset] = value
+		return message
+	}
+
+	tests := []struct {
+		name    string
+		message []byte
+		want    error
+	}{
+		{"empty", nil, ErrShortMessage},
+		{"shorter than v1", v1[:headerSizeV1-1], ErrShortMessage},
+		{"v2 shorter than its header", v2[:HeaderSize-1], ErrShortMessage},
+		{"bad magic", corrupt(v2, 0, 0), ErrBadMagic},
+		{"unknown version", corrupt(v2, 2, 3), ErrUnsupportedVersion},
+		{"v2 truncated payload", v2[:len(v2)-1], ErrTruncatedPayload},
+		{"v1 truncated payload", v1[:len(v1)-1], ErrTruncatedPayload},
+		// A v1 message long enough for a v2 header still decodes as v1.
+		{"v1 with payload", v1, nil},
+		{"v2 header only", encodeV2(t, Header{}, nil), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeHeader(test.message); err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		want    []byte
+	}{
+		{"too short", make([]byte, headerSizeV1-1), nil},
+		{"v1", encodeV1(Header{}, []byte("one")), []byte("one")},
+		{"v2", encodeV2(t, Header{}, []byte("two")), []byte("two")},
+		{"v2 shorter than its header", encodeV2(t, Header{}, nil)[:HeaderSize-1], nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Payload(test.message); !bytes.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
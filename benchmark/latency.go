@@ -0,0 +1,130 @@
+package benchmark
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// LatencyHistogram records latencies in nanoseconds into an HDR histogram,
+// so memory stays the same however many messages are recorded.
+type LatencyHistogram struct {
+	histogram *hdrhistogram.Histogram
+	// Latencies below zero (clock skew) are recorded as zero and those above
+	// the trackable maximum as the maximum. Both are counted.
+	Negative int64
+	Overflow int64
+}
+
+// NewLatencyHistogram tracks latencies up to HISTOGRAM_MAX_LATENCY_MS with
+// HISTOGRAM_SIGFIGS significant digits (1-5).
+func NewLatencyHistogram() *LatencyHistogram {
+	maxLatency, _ := strconv.ParseInt(getEnv("HISTOGRAM_MAX_LATENCY_MS", "60000"), 10, 64)
+	sigfigs, _ := strconv.Atoi(getEnv("HISTOGRAM_SIGFIGS", "3"))
+	if sigfigs < 1 || sigfigs > 5 {
+		log.Printf("[ERROR] HISTOGRAM_SIGFIGS must be between 1 and 5, using 3")
+		sigfigs = 3
+	}
+	if maxLatency <= 0 {
+		log.Printf("[ERROR] HISTOGRAM_MAX_LATENCY_MS must be positive, using 60000")
+		maxLatency = 60000
+	}
+	return &LatencyHistogram{
+		histogram: hdrhistogram.New(1, maxLatency*int64(time.Millisecond), sigfigs),
+	}
+}
+
+func (h *LatencyHistogram) Record(latency time.Duration) {
+	ns := int64(latency)
+	if ns < 0 {
+		h.Negative++
+		ns = 0
+	}
+	if ns > h.histogram.HighestTrackableValue() {
+		h.Overflow++
+		ns = h.histogram.HighestTrackableValue()
+	}
+	h.histogram.RecordValue(ns)
+}
+
+// Merge adds the latencies of other, for example from another consumer or run.
+func (h *LatencyHistogram) Merge(other *LatencyHistogram) {
+	h.Overflow += h.histogram.Merge(other.histogram) + other.Overflow
+	h.Negative += other.Negative
+}
+
+func (h *LatencyHistogram) Reset() {
+	h.histogram.Reset()
+	h.Negative = 0
+	h.Overflow = 0
+}
+
+func (h *LatencyHistogram) Count() int64 {
+	return h.histogram.TotalCount()
+}
+
+// MarshalText encodes the histogram in the compressed HdrHistogram V2 format
+// (base64), which other HdrHistogram tools read as well.
+func (h *LatencyHistogram) MarshalText() ([]byte, error) {
+	return h.histogram.Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+}
+
+func (h *LatencyHistogram) UnmarshalText(text []byte) error {
+	histogram, err := hdrhistogram.Decode(text)
+	if err != nil {
+		return err
+	}
+	h.histogram = histogram
+	return nil
+}
+
+// Quantile returns the latency in milliseconds at quantile q (0-100).
+func (h *LatencyHistogram) Quantile(q float64) float64 {
+	return float64(h.histogram.ValueAtQuantile(q)) / 1000000.0
+}
+
+// LatencySummary holds the usual percentiles, all in milliseconds.
+type LatencySummary struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p99_9"`
+	P9999 float64 `json:"p99_99"`
+	Max   float64 `json:"max"`
+}
+
+func (h *LatencyHistogram) Summary() LatencySummary {
+	return LatencySummary{
+		Count: h.histogram.TotalCount(),
+		Min:   float64(h.histogram.Min()) / 1000000.0,
+		Mean:  h.histogram.Mean() / 1000000.0,
+		P50:   h.Quantile(50),
+		P90:   h.Quantile(90),
+		P99:   h.Quantile(99),
+		P999:  h.Quantile(99.9),
+		P9999: h.Quantile(99.99),
+		Max:   float64(h.histogram.Max()) / 1000000.0,
+	}
+}
+
+func (s LatencySummary) String() string {
+	return fmt.Sprintf("min %f, p50 %f, p90 %f, p99 %f, p99.9 %f, p99.99 %f, max %f ms (mean %f ms)",
+		s.Min, s.P50, s.P90, s.P99, s.P999, s.P9999, s.Max, s.Mean)
+}
+
+// Distribution returns the cumulative distribution as (percentile, latency in
+// milliseconds, count) rows.
+func (h *LatencyHistogram) Distribution() [][3]float64 {
+	brackets := h.histogram.CumulativeDistribution()
+	rows := make([][3]float64, len(brackets))
+	for i, bracket := range brackets {
+		rows[i] = [3]float64{bracket.Quantile, float64(bracket.ValueAt) / 1000000.0, float64(bracket.Count)}
+	}
+	return rows
+}
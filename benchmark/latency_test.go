@@ -0,0 +1,131 @@
+package benchmark
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// within checks got against want in milliseconds at the precision of a
+// histogram with 3 significant digits.
+func within(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > want/1000 {
+		t.Errorf("%s %f ms, want %f ms", name, got, want)
+	}
+}
+
+// newTestHistogram records from to to milliseconds, each once.
+func newTestHistogram(t *testing.T, from, to int) *LatencyHistogram {
+	t.Helper()
+	h := NewLatencyHistogram()
+	for ms := from; ms <= to; ms++ {
+		h.Record(time.Duration(ms) * time.Millisecond)
+	}
+	return h
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	h := newTestHistogram(t, 1, 1000)
+
+	summary := h.Summary()
+	if summary.Count != 1000 {
+		t.Errorf("count %d, want 1000", summary.Count)
+	}
+	tests := []struct {
+		name      string
+		got, want float64
+	}{
+		{"min", summary.Min, 1},
+		{"p50", summary.P50, 500},
+		{"p90", summary.P90, 900},
+		{"p99", summary.P99, 990},
+		{"p99.9", summary.P999, 999},
+		{"p99.99", summary.P9999, 1000},
+		{"max", summary.Max, 1000},
+		{"mean", summary.Mean, 500.5},
+	}
+	for _, test := range tests {
+		within(t, test.name, test.got, test.want)
+	}
+
+	rows := h.Distribution()
+	if len(rows) == 0 {
+		t.Fatal("empty distribution")
+	}
+	last := rows[len(rows)-1]
+	if last[0] != 100 || last[2] != 1000 {
+		t.Errorf("distribution ends at percentile %f with count %f, want 100 and 1000", last[0], last[2])
+	}
+}
+
+func TestLatencyClamping(t *testing.T) {
+	t.Setenv("HISTOGRAM_MAX_LATENCY_MS", "100")
+	h := NewLatencyHistogram()
+	h.Record(-time.Millisecond)
+	h.Record(50 * time.Millisecond)
+	h.Record(time.Second)
+
+	if h.Negative != 1 || h.Overflow != 1 {
+		t.Errorf("negative %d, overflow %d, want 1 each", h.Negative, h.Overflow)
+	}
+	if h.Count() != 3 {
+		t.Errorf("count %d, want 3, clamped latencies are still recorded", h.Count())
+	}
+	summary := h.Summary()
+	within(t, "max", summary.Max, 100)
+	if summary.Min != 0 {
+		t.Errorf("min %f ms, want 0", summary.Min)
+	}
+
+	h.Reset()
+	if h.Count() != 0 || h.Negative != 0 || h.Overflow != 0 {
+		t.Errorf("after reset count %d, negative %d, overflow %d", h.Count(), h.Negative, h.Overflow)
+	}
+}
+
+func TestLatencyMerge(t *testing.T) {
+	h := newTestHistogram(t, 1, 500)
+	h.Record(-time.Millisecond)
+	other := newTestHistogram(t, 501, 1000)
+	other.Record(-time.Millisecond)
+	other.Overflow = 2
+
+	h.Merge(other)
+	if h.Count() != 1002 {
+		t.Errorf("count %d, want 1002", h.Count())
+	}
+	if h.Negative != 2 || h.Overflow != 2 {
+		t.Errorf("negative %d, overflow %d, want 2 each", h.Negative, h.Overflow)
+	}
+	within(t, "p50", h.Quantile(50), 499)
+	within(t, "max", h.Summary().Max, 1000)
+	if other.Count() != 501 {
+		t.Errorf("merge changed the other histogram to %d latencies", other.Count())
+	}
+
+	// Latencies beyond the maximum of the merged histogram count as overflow.
+	t.Setenv("HISTOGRAM_MAX_LATENCY_MS", "100")
+	small := NewLatencyHistogram()
+	small.Merge(newTestHistogram(t, 1, 10))
+	t.Setenv("HISTOGRAM_MAX_LATENCY_MS", "60000")
+	small.Merge(newTestHistogram(t, 1000, 1001))
+	if small.Overflow != 2 {
+		t.Errorf("overflow %d, want 2", small.Overflow)
+	}
+}
+
+func TestLatencyMarshalText(t *testing.T) {
+	h := newTestHistogram(t, 1, 1000)
+	text, err := h.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded LatencyHistogram
+	if err := decoded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Summary() != h.Summary() {
+		t.Errorf("decoded %s, want %s", decoded.Summary(), h.Summary())
+	}
+}
@@ -0,0 +1,73 @@
+// Package metrics exposes live counters of a running test in the Prometheus
+// text format.
+package metrics
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	MessagesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqbench_messages_sent_total",
+		Help: "Messages handed to the driver by the producer.",
+	})
+	BytesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqbench_bytes_sent_total",
+		Help: "Bytes handed to the driver by the producer.",
+	})
+	ControlMessagesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqbench_control_messages_sent_total",
+		Help: "Control messages, such as clock estimates, handed to the driver by the producer.",
+	})
+	PublishErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqbench_publish_errors_total",
+		Help: "Messages the broker client failed to publish.",
+	})
+	InFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mqbench_sends_in_flight",
+		Help: "Sends started by the producer that have not returned yet.",
+	})
+	MessagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqbench_messages_received_total",
+		Help: "Messages with a valid header received by the consumer.",
+	})
+	BytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqbench_bytes_received_total",
+		Help: "Bytes of the messages received by the consumer.",
+	})
+	InvalidMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqbench_invalid_messages_total",
+		Help: "Messages discarded by the consumer for lack of a valid header.",
+	})
+	Latency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "mqbench_latency_seconds",
+		Help: "Time from send to receive of each message.",
+		// 10us to about 84s
+		Buckets: prometheus.ExponentialBuckets(0.00001, 2, 24),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(MessagesSent, BytesSent, ControlMessagesSent, PublishErrors, InFlight,
+		MessagesReceived, BytesReceived, InvalidMessages, Latency)
+}
+
+// Serve exposes /metrics on addr in the background. An empty addr does
+// nothing, the counters are still updated.
+func Serve(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Serving metrics on %s/metrics", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("[ERROR] Metrics endpoint stopped: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package mq
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// envOptions reads driver options from the environment. The first invalid
+// value is kept in err, so a constructor reads all of its options and checks
+// once.
+type envOptions struct {
+	err error
+}
+
+func (options *envOptions) invalid(key, value, want string) {
+	if options.err == nil {
+		options.err = fmt.Errorf("%s must be %s, got %q", key, want, value)
+	}
+}
+
+// int reads a non-negative integer.
+func (options *envOptions) int(key, defaultValue string) int {
+	return options.intRange(key, defaultValue, 0, math.MaxInt32)
+}
+
+// intRange reads an integer from min to max.
+func (options *envOptions) intRange(key, defaultValue string, min, max int) int {
+	value := getEnv(key, defaultValue)
+	v, err := strconv.Atoi(value)
+	if err != nil || v < min || v > max {
+		want := fmt.Sprintf("an integer from %d to %d", min, max)
+		switch {
+		case max == math.MaxInt32 && min == 0:
+			want = "a non-negative integer"
+		case max == math.MaxInt32:
+			want = fmt.Sprintf("an integer of at least %d", min)
+		}
+		options.invalid(key, value, want)
+		return min
+	}
+	return v
+}
+
+// float reads a number from min to max.
+func (options *envOptions) float(key, defaultValue string, min, max float64) float64 {
+	value := getEnv(key, defaultValue)
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || v < min || v > max {
+		options.invalid(key, value, fmt.Sprintf("a number from %g to %g", min, max))
+		return min
+	}
+	return v
+}
+
+func (options *envOptions) bool(key, defaultValue string) bool {
+	value := getEnv(key, defaultValue)
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		options.invalid(key, value, "true or false")
+	}
+	return v
+}
+
+// choice reads one of choices.
+func (options *envOptions) choice(key, defaultValue string, choices ...string) string {
+	value := getEnv(key, defaultValue)
+	for _, choice := range choices {
+		if value == choice {
+			return value
+		}
+	}
+	options.invalid(key, value, "one of "+strings.Join(choices, ", "))
+	return value
+}
@@ -0,0 +1,86 @@
+package mq
+
+import "testing"
+
+// TestInvalidOptions checks that constructors reject invalid options before
+// they connect to anything.
+func TestInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		new   func() error
+	}{
+		{"loopback queue", "LOOPBACK_QUEUE_SIZE", "many", newLoopbackErr},
+		{"negative queue", "LOOPBACK_QUEUE_SIZE", "-1", newLoopbackErr},
+		{"duration", "TEST_DURATION", "1s", newLoopbackErr},
+		{"nsq batch", "NSQ_BATCH_SIZE", "0", newNsqErr},
+		{"nsq flush interval", "NSQ_FLUSH_INTERVAL_MS", "soon", newNsqErr},
+		{"nsq publish mode", "NSQ_PUBLISH_MODE", "batch", newNsqErr},
+		{"nsq requeue percent", "NSQ_REQUEUE_PERCENT", "150", newNsqErr},
+		{"nsq max attempts", "NSQ_MAX_ATTEMPTS", "70000", newNsqErr},
+		{"nsq handlers", "NSQ_CONCURRENT_HANDLERS", "0", newNsqErr},
+		{"kafka acks", "KAFKA_ACKS", "2", newKafkaErr},
+		{"kafka linger", "KAFKA_LINGER_MS", "10ms", newKafkaErr},
+		{"amqp confirm", "AMQP_CONFIRM", "yes please", newAmqpErr},
+		{"amqp ack mode", "AMQP_ACK_MODE", "lazy", newAmqpErr},
+		{"jetstream storage", "JETSTREAM_STORAGE", "disk", newJetStreamErr},
+		{"jetstream replicas", "JETSTREAM_REPLICAS", "0", newJetStreamErr},
+		{"mqtt qos", "MQTT_QOS", "3", newMqttErr},
+		{"mqtt retained", "MQTT_RETAINED", "sometimes", newMqttErr},
+		{"redis read count", "REDIS_READ_COUNT", "0", newRedisStreamsErr},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.key, test.value)
+			if err := test.new(); err == nil {
+				t.Errorf("no error for %s=%s", test.key, test.value)
+			}
+		})
+	}
+
+	// Deferrals are only checked for the mode that uses them.
+	t.Setenv("NSQ_DEFER_MS", "1000,later")
+	if err := newNsqErr(); err != nil {
+		t.Errorf("NSQ_DEFER_MS checked for async: %s", err)
+	}
+	t.Setenv("NSQ_PUBLISH_MODE", "deferred")
+	if err := newNsqErr(); err == nil {
+		t.Error("no error for an invalid NSQ_DEFER_MS")
+	}
+}
+
+func newLoopbackErr() error {
+	_, err := NewLoopback(0, "all")
+	return err
+}
+
+func newNsqErr() error {
+	_, err := NewNsq(0, "producer")
+	return err
+}
+
+func newKafkaErr() error {
+	_, err := NewKafka(0, "producer")
+	return err
+}
+
+func newAmqpErr() error {
+	_, err := NewAmqp(0, "producer")
+	return err
+}
+
+func newJetStreamErr() error {
+	_, err := NewJetStream(0, "producer")
+	return err
+}
+
+func newMqttErr() error {
+	_, err := NewMqtt(0, "producer")
+	return err
+}
+
+func newRedisStreamsErr() error {
+	_, err := NewRedisStreams(0, "producer")
+	return err
+}
@@ -0,0 +1,134 @@
+package mq
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+type JetStream struct {
+	handler   benchmark.MessageHandler
+	conn      *nats.Conn
+	js        nats.JetStreamContext
+	sub       *nats.Subscription
+	topic     string
+	ackPolicy string
+	options   map[string]string
+	mode      string
+}
+
+func jetStreamAckOption(ackPolicy string) nats.SubOpt {
+	switch ackPolicy {
+	case "none":
+		return nats.AckNone()
+	case "all":
+		return nats.AckAll()
+	default:
+		return nats.AckExplicit()
+	}
+}
+
+func NewJetStream(numberOfMessages int, clientMode string) (*JetStream, error) {
+	topic := getEnv("TOPIC_NAME", "default")
+	conn := getEnv("MQ_CONNECTION_STRING", nats.DefaultURL)
+	stream := getEnv("JETSTREAM_STREAM", "BENCHMARK")
+	var env envOptions
+	storage := env.choice("JETSTREAM_STORAGE", "memory", "memory", "file")
+	replicas := env.intRange("JETSTREAM_REPLICAS", "1", 1, math.MaxInt32)
+	ackPolicy := env.choice("JETSTREAM_ACK_POLICY", "explicit", "none", "all", "explicit")
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	log.Printf("[JetStreamClient] Connect to %s (stream=%s, storage=%s, replicas=%d, ack=%s)",
+		conn, stream, storage, replicas, ackPolicy)
+
+	nc, err := nats.Connect(conn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect: %s", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open JetStream context: %s", err)
+	}
+
+	storageType := nats.MemoryStorage
+	if storage == "file" {
+		storageType = nats.FileStorage
+	}
+	if _, err := js.StreamInfo(stream); err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     stream,
+			Subjects: []string{topic},
+			Storage:  storageType,
+			Replicas: replicas,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot create stream %s: %s", stream, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot look up stream %s: %s", stream, err)
+	}
+
+	return &JetStream{
+		handler:   benchmark.NewAllInOneMessageHandler(numberOfMessages, duration),
+		conn:      nc,
+		js:        js,
+		topic:     topic,
+		ackPolicy: ackPolicy,
+		options: map[string]string{
+			"MQ_CONNECTION_STRING": conn,
+			"JETSTREAM_STREAM":     stream,
+			"JETSTREAM_STORAGE":    storage,
+			"JETSTREAM_REPLICAS":   strconv.Itoa(replicas),
+			"JETSTREAM_ACK_POLICY": ackPolicy,
+		},
+		mode: clientMode,
+	}, nil
+}
+
+func (j *JetStream) Options() map[string]string {
+	return j.options
+}
+
+func (j *JetStream) Setup() {
+	if benchmark.Consumes(j.mode) {
+		var err error
+		j.sub, err = j.js.Subscribe(j.topic, func(message *nats.Msg) {
+			j.handler.ReceiveMessage(message.Data)
+			if j.ackPolicy != "none" {
+				message.Ack()
+			}
+		}, nats.DeliverNew(), nats.ManualAck(), jetStreamAckOption(j.ackPolicy))
+		if err != nil {
+			log.Fatalf("[JetStreamClient] Cannot subscribe to %s: %s", j.topic, err)
+		}
+		log.Printf("[JetStreamClient] Subscribe to %s", j.topic)
+	}
+}
+
+func (j *JetStream) Teardown() {
+	if j.sub != nil {
+		j.sub.Unsubscribe()
+	}
+	j.conn.Drain()
+}
+
+// Send waits for the stream's publish acknowledgement, so the measured send
+// path includes persistence in the stream.
+func (j *JetStream) Send(message []byte) {
+	if _, err := j.js.Publish(j.topic, message); err != nil {
+		log.Printf("[JetStreamClient] Publish error: %s", err)
+		metrics.PublishErrors.Inc()
+	}
+}
+
+func (j *JetStream) MessageHandler() *benchmark.MessageHandler {
+	return &j.handler
+}
@@ -0,0 +1,225 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+)
+
+type Kafka struct {
+	handler benchmark.MessageHandler
+	pub     sarama.AsyncProducer
+	// pubDone is closed once every publish error has been counted.
+	pubDone chan bool
+	group   sarama.ConsumerGroup
+	cancel  context.CancelFunc
+	topic   string
+	options map[string]string
+	mode    string
+}
+
+// kafkaConsumerHandler feeds every claimed message to the benchmark handler.
+type kafkaConsumerHandler struct {
+	handler benchmark.MessageHandler
+}
+
+func (h kafkaConsumerHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h kafkaConsumerHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h kafkaConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for message := range claim.Messages() {
+		h.handler.ReceiveMessage(message.Value)
+		session.MarkMessage(message, "")
+	}
+	return nil
+}
+
+func kafkaRequiredAcks(acks string) sarama.RequiredAcks {
+	switch acks {
+	case "0":
+		return sarama.NoResponse
+	case "all", "-1":
+		return sarama.WaitForAll
+	default:
+		return sarama.WaitForLocal
+	}
+}
+
+// KafkaConfig is everything NewKafkaWithConfig needs. Tests use it to point
+// the driver at a sarama.MockBroker.
+type KafkaConfig struct {
+	Brokers    []string
+	Topic      string
+	Group      string
+	Partitions int
+	// Timeout stops the consumer this many milliseconds after the first
+	// message, 0 waits for a FIN.
+	Timeout int
+	Sarama  *sarama.Config
+	// Options are reported with the results.
+	Options map[string]string
+}
+
+// NewKafka reads the Kafka settings from the environment.
+func NewKafka(numberOfMessages int, clientMode string) (*Kafka, error) {
+	topic := getEnv("TOPIC_NAME", "default")
+	brokers := strings.Split(getEnv("MQ_CONNECTION_STRING", "localhost:9092"), ",")
+	group := getEnv("KAFKA_CONSUMER_GROUP", "test")
+	var env envOptions
+	acks := env.choice("KAFKA_ACKS", "1", "0", "1", "all", "-1")
+	lingerMs := env.int("KAFKA_LINGER_MS", "0")
+	batchSize := env.int("KAFKA_BATCH_SIZE", "0")
+	partitions := env.int("KAFKA_PARTITIONS", "0")
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	version, err := sarama.ParseKafkaVersion(getEnv("KAFKA_VERSION", "1.0.0"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KAFKA_VERSION: %s", err)
+	}
+
+	config := sarama.NewConfig()
+	config.Version = version
+	config.Producer.RequiredAcks = kafkaRequiredAcks(acks)
+	config.Producer.Flush.Frequency = time.Duration(lingerMs) * time.Millisecond
+	config.Producer.Flush.Bytes = batchSize
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	log.Printf("[KafkaClient] Connect to %s (acks=%s, linger=%dms, batch=%d bytes)",
+		strings.Join(brokers, ","), acks, lingerMs, batchSize)
+
+	return NewKafkaWithConfig(numberOfMessages, clientMode, KafkaConfig{
+		Brokers:    brokers,
+		Topic:      topic,
+		Group:      group,
+		Partitions: partitions,
+		Timeout:    duration,
+		Sarama:     config,
+		Options: map[string]string{
+			"MQ_CONNECTION_STRING": strings.Join(brokers, ","),
+			"KAFKA_VERSION":        version.String(),
+			"KAFKA_ACKS":           acks,
+			"KAFKA_LINGER_MS":      strconv.Itoa(lingerMs),
+			"KAFKA_BATCH_SIZE":     strconv.Itoa(batchSize),
+			"KAFKA_PARTITIONS":     strconv.Itoa(partitions),
+			"KAFKA_CONSUMER_GROUP": group,
+		},
+	})
+}
+
+func NewKafkaWithConfig(numberOfMessages int, clientMode string, config KafkaConfig) (*Kafka, error) {
+	if config.Partitions > 0 {
+		createKafkaTopic(config.Brokers, config.Sarama, config.Topic, config.Partitions)
+	}
+
+	k := &Kafka{
+		handler: benchmark.NewAllInOneMessageHandler(numberOfMessages, config.Timeout),
+		topic:   config.Topic,
+		options: config.Options,
+		mode:    clientMode,
+	}
+
+	var err error
+	if benchmark.Consumes(clientMode) {
+		k.group, err = sarama.NewConsumerGroup(config.Brokers, config.Group, config.Sarama)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create consumer group: %s", err)
+		}
+	}
+	if benchmark.Produces(clientMode) {
+		k.pub, err = sarama.NewAsyncProducer(config.Brokers, config.Sarama)
+		if err != nil {
+			if k.group != nil {
+				k.group.Close()
+			}
+			return nil, fmt.Errorf("cannot create producer: %s", err)
+		}
+		k.pubDone = make(chan bool)
+		go func() {
+			defer close(k.pubDone)
+			for err := range k.pub.Errors() {
+				log.Printf("[KafkaClient] Publish error: %s", err)
+				metrics.PublishErrors.Inc()
+			}
+		}()
+	}
+
+	return k, nil
+}
+
+// createKafkaTopic makes sure the topic exists with the requested number of
+// partitions. An already existing topic is left untouched.
+func createKafkaTopic(brokers []string, config *sarama.Config, topic string, partitions int) {
+	admin, err := sarama.NewClusterAdmin(brokers, config)
+	if err != nil {
+		log.Printf("[KafkaClient] Cannot connect cluster admin: %s", err)
+		return
+	}
+	defer admin.Close()
+
+	err = admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     int32(partitions),
+		ReplicationFactor: 1,
+	}, false)
+	if err != nil && err != sarama.ErrTopicAlreadyExists {
+		log.Printf("[KafkaClient] Cannot create topic %s: %s", topic, err)
+		return
+	}
+	log.Printf("[KafkaClient] Topic %s has %d partitions", topic, partitions)
+}
+
+func (k *Kafka) Options() map[string]string {
+	return k.options
+}
+
+func (k *Kafka) Setup() {
+	if benchmark.Consumes(k.mode) {
+		ctx, cancel := context.WithCancel(context.Background())
+		k.cancel = cancel
+		log.Printf("[KafkaClient] Subscribe to %s", k.topic)
+		go func() {
+			// Consume returns on every rebalance, so keep rejoining until teardown.
+			for ctx.Err() == nil {
+				if err := k.group.Consume(ctx, []string{k.topic}, kafkaConsumerHandler{k.handler}); err != nil {
+					log.Printf("[KafkaClient] Consume error: %s", err)
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+	}
+}
+
+func (k *Kafka) Teardown() {
+	if k.cancel != nil {
+		k.cancel()
+	}
+	if k.group != nil {
+		k.group.Close()
+	}
+	if k.pub != nil {
+		// Close would drain the errors itself, AsyncClose leaves them to the
+		// goroutine counting them.
+		k.pub.AsyncClose()
+		<-k.pubDone
+	}
+}
+
+func (k *Kafka) Send(message []byte) {
+	k.pub.Input() <- &sarama.ProducerMessage{
+		Topic: k.topic,
+		Value: sarama.ByteEncoder(message),
+	}
+}
+
+func (k *Kafka) MessageHandler() *benchmark.MessageHandler {
+	return &k.handler
+}
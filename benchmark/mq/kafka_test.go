@@ -0,0 +1,145 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	kafkaTestTopic = "benchmark"
+	kafkaTestGroup = "test"
+)
+
+func kafkaTestConfig(broker *sarama.MockBroker) KafkaConfig {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_0_0
+	config.Metadata.Retry.Max = 0
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Consumer.Group.Rebalance.Retry.Max = 2
+	return KafkaConfig{
+		Brokers: []string{broker.Addr()},
+		Topic:   kafkaTestTopic,
+		Group:   kafkaTestGroup,
+		Sarama:  config,
+	}
+}
+
+func TestKafkaConsumerGroup(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 0)
+	defer broker.Close()
+
+	fetch := sarama.NewMockFetchResponse(t, 1)
+	for i := uint64(1); i <= 3; i++ {
+		fetch.SetMessage(kafkaTestTopic, 0, int64(i-1), sarama.ByteEncoder(testMessage(t, i, 0)))
+	}
+	fetch.SetMessage(kafkaTestTopic, 0, 3, sarama.ByteEncoder(testMessage(t, 3, benchmark.FlagFin)))
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(kafkaTestTopic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(kafkaTestTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(kafkaTestTopic, 0, sarama.OffsetNewest, 4),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, kafkaTestGroup, broker),
+		"HeartbeatRequest":  sarama.NewMockHeartbeatResponse(t),
+		"JoinGroupRequest":  sarama.NewMockJoinGroupResponse(t).SetGroupProtocol(sarama.RangeBalanceStrategyName),
+		"LeaveGroupRequest": sarama.NewMockLeaveGroupResponse(t),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&sarama.ConsumerGroupMemberAssignment{Topics: map[string][]int32{kafkaTestTopic: {0}}}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset(kafkaTestGroup, kafkaTestTopic, 0, -1, "", sarama.ErrNoError),
+		"FetchRequest": fetch,
+	})
+
+	k, err := NewKafkaWithConfig(0, "consumer", kafkaTestConfig(broker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Setup()
+	defer k.Teardown()
+
+	result := waitForCompletion(t, *k.MessageHandler(), 10*time.Second)
+	if result.Messages != 4 {
+		t.Errorf("received %d messages, want 4", result.Messages)
+	}
+	if result.Delivery.Expected != 3 || result.Delivery.Lost != 0 || result.Delivery.Duplicates != 0 {
+		t.Errorf("delivery %+v, want 3 expected and nothing lost or duplicated", result.Delivery)
+	}
+}
+
+// kafkaProduceVersion is the ProduceRequest version sarama sends for the
+// Kafka version of kafkaTestConfig, the mock has to answer in kind.
+const kafkaProduceVersion = 3
+
+func TestKafkaProducer(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    sarama.KError
+		errors float64
+	}{
+		{"acked", sarama.ErrNoError, 0},
+		// Every message fails, the producer does not retry this error.
+		{"rejected", sarama.ErrInvalidMessage, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := sarama.NewMockBroker(t, 0)
+			defer broker.Close()
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader(kafkaTestTopic, 0, broker.BrokerID()),
+				"ProduceRequest": sarama.NewMockProduceResponse(t).
+					SetVersion(kafkaProduceVersion).
+					SetError(kafkaTestTopic, 0, test.err),
+			})
+
+			k, err := NewKafkaWithConfig(0, "producer", kafkaTestConfig(broker))
+			if err != nil {
+				t.Fatal(err)
+			}
+			errors := testutil.ToFloat64(metrics.PublishErrors)
+			for i := uint64(1); i <= 3; i++ {
+				k.Send(testMessage(t, i, 0))
+			}
+			// Closing the producer flushes what it has buffered and waits
+			// for the errors to be counted.
+			k.Teardown()
+
+			produced := 0
+			for _, exchange := range broker.History() {
+				if request, ok := exchange.Request.(*sarama.ProduceRequest); ok {
+					produced++
+					if request.Version != kafkaProduceVersion {
+						t.Errorf("produce request version %d, the mock answers %d", request.Version, kafkaProduceVersion)
+					}
+				}
+			}
+			if produced == 0 {
+				t.Error("broker got no produce request")
+			}
+			if got := testutil.ToFloat64(metrics.PublishErrors) - errors; got != test.errors {
+				t.Errorf("%f publish errors, want %f", got, test.errors)
+			}
+		})
+	}
+}
+
+func TestKafkaUnreachableBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 0)
+	config := kafkaTestConfig(broker)
+	broker.Close()
+
+	for _, mode := range []string{"consumer", "producer"} {
+		if _, err := NewKafkaWithConfig(0, mode, config); err == nil {
+			t.Errorf("%s: no error for a broker that is down", mode)
+		}
+	}
+}
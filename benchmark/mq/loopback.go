@@ -0,0 +1,81 @@
+package mq
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+)
+
+// Loopback has no broker: Send hands the message straight to the handler of
+// the same process. Results are the floor of what the harness itself costs.
+type Loopback struct {
+	handler benchmark.MessageHandler
+	queue   chan []byte
+	done    chan bool
+}
+
+func NewLoopback(numberOfMessages int, clientMode string) (*Loopback, error) {
+	var env envOptions
+	queueSize := env.int("LOOPBACK_QUEUE_SIZE", "0")
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	l := &Loopback{
+		handler: benchmark.NewAllInOneMessageHandler(numberOfMessages, duration),
+		done:    make(chan bool),
+	}
+
+	// Producer and consumer are the same tester, so only mode "all" gets
+	// results. main rejects the others.
+	if queueSize > 0 {
+		log.Printf("[LoopbackClient] Deliver through a channel of %d messages", queueSize)
+		l.queue = make(chan []byte, queueSize)
+		go l.receive()
+	} else {
+		log.Printf("[LoopbackClient] Deliver directly to the handler")
+	}
+
+	return l, nil
+}
+
+func (l *Loopback) receive() {
+	for {
+		select {
+		case message := <-l.queue:
+			l.handler.ReceiveMessage(message)
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *Loopback) Options() map[string]string {
+	return map[string]string{
+		"LOOPBACK_QUEUE_SIZE": strconv.Itoa(cap(l.queue)),
+	}
+}
+
+func (l *Loopback) Setup() {
+}
+
+func (l *Loopback) Teardown() {
+	close(l.done)
+}
+
+func (l *Loopback) Send(message []byte) {
+	if l.queue == nil {
+		l.handler.ReceiveMessage(message)
+		return
+	}
+	select {
+	case l.queue <- message:
+	case <-l.done:
+	}
+}
+
+func (l *Loopback) MessageHandler() *benchmark.MessageHandler {
+	return &l.handler
+}
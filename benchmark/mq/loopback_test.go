@@ -0,0 +1,124 @@
+package mq
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+)
+
+// TestLoopbackTester runs a whole test through Tester.Test without a broker
+// and checks the report it writes.
+func TestLoopbackTester(t *testing.T) {
+	for _, queueSize := range []int{0, 16} {
+		t.Run("queue="+strconv.Itoa(queueSize), func(t *testing.T) {
+			t.Setenv("LOOPBACK_QUEUE_SIZE", strconv.Itoa(queueSize))
+			t.Setenv("MSG_UNIFORM_DELAY_US", "2000")
+			t.Setenv("MSG_UNIFORM_SIZE", "128")
+			t.Setenv("FIN_ENABLED", "true")
+			t.Setenv("SETUP_DELAY_MS", "0")
+			reportFile := filepath.Join(t.TempDir(), "report.json")
+
+			// The consumer would stop TEST_DURATION after the first message,
+			// racing the FIN. Without a timeout only the FIN ends it.
+			t.Setenv("TEST_DURATION", "0")
+			loopback, err := NewLoopback(0, "all")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("TEST_DURATION", "200")
+			tester := benchmark.Tester{
+				Name:            "loopback",
+				MessageSender:   loopback,
+				MessageReceiver: loopback,
+				Mode:            "all",
+				ReportFile:      reportFile,
+				ProducerID:      7,
+			}
+			if err := tester.Test(); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := benchmark.ReadReport(reportFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Producer == nil || report.Consumer == nil {
+				t.Fatalf("report of mode all lacks a side: producer %v, consumer %v", report.Producer, report.Consumer)
+			}
+			sent := report.Producer.Messages
+			if sent == 0 {
+				t.Fatal("producer sent nothing")
+			}
+			delivery := report.Consumer.Producers[7]
+			if delivery.Expected != uint64(sent) || delivery.Lost != 0 || delivery.Duplicates != 0 {
+				t.Errorf("delivery %+v, want %d expected and nothing lost or duplicated", delivery, sent)
+			}
+			// The FIN that ends the test is counted as well.
+			if report.Consumer.Messages != sent+1 {
+				t.Errorf("consumer got %d messages, want %d", report.Consumer.Messages, sent+1)
+			}
+			for _, name := range []string{"report_latency.csv", "report_response_latency.csv"} {
+				if _, err := os.Stat(filepath.Join(filepath.Dir(reportFile), name)); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoopbackTesterReportError(t *testing.T) {
+	t.Setenv("TEST_DURATION", "50")
+	t.Setenv("FIN_ENABLED", "true")
+	t.Setenv("SETUP_DELAY_MS", "0")
+	loopback, err := NewLoopback(0, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := benchmark.Tester{
+		Name:            "loopback",
+		MessageSender:   loopback,
+		MessageReceiver: loopback,
+		Mode:            "all",
+		ReportFile:      filepath.Join(t.TempDir(), "missing", "report.json"),
+	}
+	if err := tester.Test(); err == nil {
+		t.Error("no error for a report that cannot be written")
+	}
+}
+
+// TestLoopbackTesterCount stops both sides after MESSAGE_COUNT messages,
+// without a duration or FIN.
+func TestLoopbackTesterCount(t *testing.T) {
+	t.Setenv("TEST_DURATION", "0")
+	t.Setenv("MSG_UNIFORM_DELAY_US", "100")
+	t.Setenv("SETUP_DELAY_MS", "0")
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+
+	loopback, err := NewLoopback(25, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester := benchmark.Tester{
+		Name:            "loopback",
+		MessageCount:    25,
+		MessageSender:   loopback,
+		MessageReceiver: loopback,
+		Mode:            "all",
+		ReportFile:      reportFile,
+		ProducerID:      7,
+	}
+	if err := tester.Test(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := benchmark.ReadReport(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Producer.Messages != 25 || report.Consumer.Messages != 25 {
+		t.Errorf("sent %d and received %d messages, want 25", report.Producer.Messages, report.Consumer.Messages)
+	}
+}
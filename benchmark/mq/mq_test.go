@@ -0,0 +1,32 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+)
+
+// testMessage is an encoded benchmark message of producer 1.
+func testMessage(t *testing.T, sequence uint64, flags uint8) []byte {
+	message := make([]byte, benchmark.HeaderSize+16)
+	now := time.Now().UnixNano()
+	header := benchmark.Header{Flags: flags, ProducerID: 1, Sequence: sequence, SendTime: now, IntendedTime: now}
+	if err := header.Encode(message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// waitForCompletion waits until the handler has seen a FIN or gives up.
+func waitForCompletion(t *testing.T, handler benchmark.MessageHandler, timeout time.Duration) *benchmark.ConsumerResult {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !handler.HasCompleted() {
+		if time.Now().After(deadline) {
+			t.Fatalf("handler did not complete within %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return handler.(*benchmark.AllInOneMessageHandler).Result()
+}
@@ -0,0 +1,108 @@
+package mq
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+)
+
+// mqttClients counts the clients created in this process.
+var mqttClients uint32
+
+type Mqtt struct {
+	handler  benchmark.MessageHandler
+	client   mqtt.Client
+	topic    string
+	qos      byte
+	retained bool
+	options  map[string]string
+	mode     string
+}
+
+func NewMqtt(numberOfMessages int, clientMode string) (*Mqtt, error) {
+	topic := getEnv("TOPIC_NAME", "default")
+	conn := getEnv("MQ_CONNECTION_STRING", "tcp://localhost:1883")
+	prefix := getEnv("MQTT_CLIENT_ID_PREFIX", "mq-benchmarking")
+	var env envOptions
+	qos := env.intRange("MQTT_QOS", "0", 0, 2)
+	cleanSession := env.bool("MQTT_CLEAN_SESSION", "true")
+	retained := env.bool("MQTT_RETAINED", "false")
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	// Client IDs must be unique per broker, a persistent session is keyed on it.
+	// Several testers in one process are numbered.
+	hostname, _ := os.Hostname()
+	clientID := fmt.Sprintf("%s-%s-%s-%d-%d", prefix, clientMode, hostname, os.Getpid(),
+		atomic.AddUint32(&mqttClients, 1))
+
+	log.Printf("[MQTTClient] Connect to %s as %s (qos=%d, clean=%t, retained=%t)",
+		conn, clientID, qos, cleanSession, retained)
+
+	options := mqtt.NewClientOptions().
+		AddBroker(conn).
+		SetClientID(clientID).
+		SetCleanSession(cleanSession)
+	client := mqtt.NewClient(options)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("cannot connect: %s", token.Error())
+	}
+
+	return &Mqtt{
+		handler:  benchmark.NewAllInOneMessageHandler(numberOfMessages, duration),
+		client:   client,
+		topic:    topic,
+		qos:      byte(qos),
+		retained: retained,
+		options: map[string]string{
+			"MQ_CONNECTION_STRING": conn,
+			"MQTT_QOS":             strconv.Itoa(qos),
+			"MQTT_CLEAN_SESSION":   strconv.FormatBool(cleanSession),
+			"MQTT_RETAINED":        strconv.FormatBool(retained),
+			"MQTT_CLIENT_ID":       clientID,
+		},
+		mode: clientMode,
+	}, nil
+}
+
+func (m *Mqtt) Options() map[string]string {
+	return m.options
+}
+
+func (m *Mqtt) Setup() {
+	if benchmark.Consumes(m.mode) {
+		token := m.client.Subscribe(m.topic, m.qos, func(client mqtt.Client, message mqtt.Message) {
+			m.handler.ReceiveMessage(message.Payload())
+		})
+		if token.Wait() && token.Error() != nil {
+			log.Fatalf("[MQTTClient] Cannot subscribe to %s: %s", m.topic, token.Error())
+		}
+		log.Printf("[MQTTClient] Subscribe to %s", m.topic)
+	}
+}
+
+func (m *Mqtt) Teardown() {
+	m.client.Disconnect(250)
+}
+
+// Send waits for the publish handshake of the configured QoS: nothing for 0,
+// PUBACK for 1 and PUBCOMP for 2.
+func (m *Mqtt) Send(message []byte) {
+	token := m.client.Publish(m.topic, m.qos, m.retained, message)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("[MQTTClient] Publish error: %s", token.Error())
+		metrics.PublishErrors.Inc()
+	}
+}
+
+func (m *Mqtt) MessageHandler() *benchmark.MessageHandler {
+	return &m.handler
+}
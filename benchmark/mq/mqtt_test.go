@@ -0,0 +1,76 @@
+package mq
+
+import (
+	"io"
+	"log/slog"
+	"strconv"
+	"testing"
+	"time"
+
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// runMqttBroker starts an embedded MQTT broker on a free port and points the
+// driver at it.
+func runMqttBroker(t *testing.T) {
+	t.Helper()
+	broker := mqttserver.New(&mqttserver.Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := broker.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve()
+	t.Cleanup(func() { broker.Close() })
+
+	t.Setenv("MQ_CONNECTION_STRING", "tcp://"+tcp.Address())
+	t.Setenv("TOPIC_NAME", "benchmark")
+	t.Setenv("TEST_DURATION", "0")
+}
+
+func TestMqtt(t *testing.T) {
+	for qos := 0; qos <= 2; qos++ {
+		t.Run("qos="+strconv.Itoa(qos), func(t *testing.T) {
+			runMqttBroker(t)
+			t.Setenv("MQTT_QOS", strconv.Itoa(qos))
+
+			m, err := NewMqtt(0, "all")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Setup()
+			defer m.Teardown()
+			sendAndReceive(t, m, *m.MessageHandler())
+		})
+	}
+}
+
+// TestMqttClientIDs checks that consumers in one process do not take over
+// each other's session.
+func TestMqttClientIDs(t *testing.T) {
+	runMqttBroker(t)
+	first, err := NewMqtt(0, "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Teardown()
+	second, err := NewMqtt(0, "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Teardown()
+
+	if first.Options()["MQTT_CLIENT_ID"] == second.Options()["MQTT_CLIENT_ID"] {
+		t.Errorf("both clients are %s", first.Options()["MQTT_CLIENT_ID"])
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !first.client.IsConnectionOpen() || !second.client.IsConnectionOpen() {
+		t.Error("a client was disconnected")
+	}
+}
@@ -0,0 +1,85 @@
+package mq
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+type Nats struct {
+	handler benchmark.MessageHandler
+	conn    *nats.Conn
+	sub     *nats.Subscription
+	topic   string
+	queue   string
+	options map[string]string
+	mode    string
+}
+
+func NewNats(numberOfMessages int, clientMode string) (*Nats, error) {
+	topic := getEnv("TOPIC_NAME", "default")
+	conn := getEnv("MQ_CONNECTION_STRING", nats.DefaultURL)
+	queue := getEnv("NATS_QUEUE_GROUP", "")
+	var env envOptions
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	log.Printf("[NATSClient] Connect to %s", conn)
+
+	nc, err := nats.Connect(conn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect: %s", err)
+	}
+
+	return &Nats{
+		handler: benchmark.NewAllInOneMessageHandler(numberOfMessages, duration),
+		conn:    nc,
+		topic:   topic,
+		queue:   queue,
+		options: map[string]string{
+			"MQ_CONNECTION_STRING": conn,
+			"NATS_QUEUE_GROUP":     queue,
+		},
+		mode: clientMode,
+	}, nil
+}
+
+func (n *Nats) Options() map[string]string {
+	return n.options
+}
+
+func (n *Nats) Setup() {
+	if benchmark.Consumes(n.mode) {
+		var err error
+		n.sub, err = n.conn.QueueSubscribe(n.topic, n.queue, func(message *nats.Msg) {
+			n.handler.ReceiveMessage(message.Data)
+		})
+		if err != nil {
+			log.Fatalf("[NATSClient] Cannot subscribe to %s: %s", n.topic, err)
+		}
+		log.Printf("[NATSClient] Subscribe to %s", n.topic)
+	}
+}
+
+func (n *Nats) Teardown() {
+	if n.sub != nil {
+		n.sub.Unsubscribe()
+	}
+	n.conn.Drain()
+}
+
+func (n *Nats) Send(message []byte) {
+	if err := n.conn.Publish(n.topic, message); err != nil {
+		log.Printf("[NATSClient] Publish error: %s", err)
+		metrics.PublishErrors.Inc()
+	}
+}
+
+func (n *Nats) MessageHandler() *benchmark.MessageHandler {
+	return &n.handler
+}
@@ -0,0 +1,107 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// runNatsServer starts an embedded nats-server on a free port and points the
+// drivers at it.
+func runNatsServer(t *testing.T, jetStream bool) {
+	t.Helper()
+	options := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: jetStream,
+	}
+	if jetStream {
+		options.StoreDir = t.TempDir()
+	}
+	s, err := server.NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats-server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+
+	t.Setenv("MQ_CONNECTION_STRING", s.ClientURL())
+	t.Setenv("TOPIC_NAME", "benchmark")
+	t.Setenv("TEST_DURATION", "0")
+}
+
+// sendAndReceive sends three messages and a FIN through a driver in mode
+// "all" and checks what its handler got.
+func sendAndReceive(t *testing.T, sender benchmark.MessageSender, handler benchmark.MessageHandler) {
+	t.Helper()
+	errors := testutil.ToFloat64(metrics.PublishErrors)
+	for i := uint64(1); i <= 3; i++ {
+		sender.Send(testMessage(t, i, 0))
+	}
+	sender.Send(testMessage(t, 3, benchmark.FlagFin))
+
+	result := waitForCompletion(t, handler, 5*time.Second)
+	if result.Messages != 4 {
+		t.Errorf("received %d messages, want 4", result.Messages)
+	}
+	if result.Delivery.Expected != 3 || result.Delivery.Lost != 0 || result.Delivery.Duplicates != 0 {
+		t.Errorf("delivery %+v, want 3 expected and nothing lost or duplicated", result.Delivery)
+	}
+	if result.Latency.Count != 4 {
+		t.Errorf("%d latencies recorded, want 4", result.Latency.Count)
+	}
+	if got := testutil.ToFloat64(metrics.PublishErrors); got != errors {
+		t.Errorf("%f publish errors, want none", got-errors)
+	}
+}
+
+func TestNats(t *testing.T) {
+	for _, queue := range []string{"", "workers"} {
+		t.Run("queue="+queue, func(t *testing.T) {
+			runNatsServer(t, false)
+			t.Setenv("NATS_QUEUE_GROUP", queue)
+
+			n, err := NewNats(0, "all")
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.Setup()
+			defer n.Teardown()
+			sendAndReceive(t, n, *n.MessageHandler())
+		})
+	}
+}
+
+func TestJetStream(t *testing.T) {
+	for _, ack := range []string{"none", "all", "explicit"} {
+		t.Run("ack="+ack, func(t *testing.T) {
+			runNatsServer(t, true)
+			t.Setenv("JETSTREAM_ACK_POLICY", ack)
+
+			j, err := NewJetStream(0, "all")
+			if err != nil {
+				t.Fatal(err)
+			}
+			j.Setup()
+			defer j.Teardown()
+			sendAndReceive(t, j, *j.MessageHandler())
+
+			info, err := j.js.StreamInfo("BENCHMARK")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.State.Msgs != 4 {
+				t.Errorf("stream holds %d messages, want 4", info.State.Msgs)
+			}
+		})
+	}
+}
@@ -1,72 +1,557 @@
 package mq
 
 import (
+	"encoding/binary"
+	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
 )
 
+// nsqRequeueStats tracks the messages failed on purpose by NSQ_REQUEUE_PERCENT
+// and how long nsqd took to deliver them again.
+type nsqRequeueStats struct {
+	lock        sync.Mutex
+	failedAt    map[nsq.MessageID]int64
+	requeued    int64
+	redelivered int64
+	redelivery  *benchmark.LatencyHistogram
+}
+
+func (s *nsqRequeueStats) fail(id nsq.MessageID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failedAt[id] = time.Now().UnixNano()
+	s.requeued++
+}
+
+func (s *nsqRequeueStats) redeliver(id nsq.MessageID) {
+	now := time.Now().UnixNano()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	failedAt, ok := s.failedAt[id]
+	if !ok {
+		return
+	}
+	delete(s.failedAt, id)
+	s.redelivered++
+	s.redelivery.Record(time.Duration(now - failedAt))
+}
+
+func (s *nsqRequeueStats) log() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log.Printf("[NSQClient] Requeued %d messages, %d redelivered", s.requeued, s.redelivered)
+	log.Printf("[NSQClient] Redelivery latency: %s", s.redelivery.Summary())
+}
+
+// add puts the requeue counts and the redelivery latency into stats.
+func (s *nsqRequeueStats) add(stats *benchmark.DriverStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats.Counters["requeued"] = s.requeued
+	stats.Counters["redelivered"] = s.redelivered
+	stats.Latencies["redelivery"] = s.redelivery.Summary()
+}
+
+// nsqPublishStats collects publish acknowledgements. For MultiPublish every
+// message of a batch shares the batch's ack latency.
+type nsqPublishStats struct {
+	lock      sync.Mutex
+	published int64
+	errors    int64
+	latencies *benchmark.LatencyHistogram
+}
+
+func (s *nsqPublishStats) record(started int64, count int, err error) {
+	latency := time.Now().UnixNano() - started
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.errors += int64(count)
+		metrics.PublishErrors.Add(float64(count))
+		return
+	}
+	s.published += int64(count)
+	for i := 0; i < count; i++ {
+		s.latencies.Record(time.Duration(latency))
+	}
+}
+
+func (s *nsqPublishStats) log() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log.Printf("[NSQClient] Published %d messages, %d errors", s.published, s.errors)
+	log.Printf("[NSQClient] Publish ack latency: %s", s.latencies.Summary())
+}
+
+// Deferred data messages carry the requested deferral in nanoseconds in the
+// first 8 bytes of the payload. FIN, warmup and control messages have payloads
+// of their own and are never stamped.
+func putNsqDeferral(message []byte, delay time.Duration) bool {
+	payload := benchmark.Payload(message)
+	if len(payload) < 8 {
+		return false
+	}
+	binary.BigEndian.PutUint64(payload, uint64(delay))
+	return true
+}
+
+func nsqDeferral(message []byte) time.Duration {
+	payload := benchmark.Payload(message)
+	if header, err := benchmark.DecodeHeader(message); err != nil || header.Flags != 0 || len(payload) < 8 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint64(payload))
+}
+
+// nsqDeferralStats compares the actual delivery of deferred messages with the
+// requested deferral, grouped by deferral. Delivery is measured from the nsqd
+// timestamp of the message, so publish latency is not part of the deviation,
+// but the clock difference between nsqd and the consumer is.
+type nsqDeferralStats struct {
+	lock   sync.Mutex
+	delays map[time.Duration]*nsqDeferralDeviation
+}
+
+type nsqDeferralDeviation struct {
+	// Deliveries before the deferral was up are counted as early and
+	// recorded as no deviation.
+	early      int64
+	deviations *benchmark.LatencyHistogram
+}
+
+func (s *nsqDeferralStats) record(delay time.Duration, deviation time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d, ok := s.delays[delay]
+	if !ok {
+		d = &nsqDeferralDeviation{deviations: benchmark.NewLatencyHistogram()}
+		s.delays[delay] = d
+	}
+	if deviation < 0 {
+		d.early++
+	}
+	d.deviations.Record(deviation)
+}
+
+func (s *nsqDeferralStats) sorted() []time.Duration {
+	delays := make([]time.Duration, 0, len(s.delays))
+	for delay := range s.delays {
+		delays = append(delays, delay)
+	}
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	return delays
+}
+
+func (s *nsqDeferralStats) log() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, delay := range s.sorted() {
+		d := s.delays[delay]
+		log.Printf("[NSQClient] Deferred %s: %d messages, %d early, deviation %s",
+			delay, d.deviations.Count(), d.early, d.deviations.Summary())
+	}
+}
+
+// add puts the deviation per deferral into stats, e.g. "deferred_1s" and
+// "deferred_1s_early" counters and a "deferral_deviation_1s" latency.
+func (s *nsqDeferralStats) add(stats *benchmark.DriverStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.delays) == 0 {
+		return
+	}
+	for _, delay := range s.sorted() {
+		d := s.delays[delay]
+		stats.Counters["deferred_"+delay.String()] = d.deviations.Count()
+		stats.Counters["deferred_"+delay.String()+"_early"] = d.early
+		stats.Latencies["deferral_deviation_"+delay.String()] = d.deviations.Summary()
+	}
+	stats.Notes = append(stats.Notes, "deferral deviation is measured from the nsqd timestamp of each message, "+
+		"it includes the clock difference between nsqd and the consumer")
+}
+
+func parseNsqDeferrals(value string) ([]time.Duration, error) {
+	var deferrals []time.Duration
+	for _, ms := range strings.Split(value, ",") {
+		delay, err := strconv.Atoi(strings.TrimSpace(ms))
+		if err != nil || delay <= 0 {
+			return nil, fmt.Errorf("NSQ_DEFER_MS must be positive milliseconds separated by commas, got %q", value)
+		}
+		deferrals = append(deferrals, time.Duration(delay)*time.Millisecond)
+	}
+	return deferrals, nil
+}
+
 type Nsq struct {
-	handler benchmark.MessageHandler
-	pub     *nsq.Producer
-	sub     *nsq.Consumer
-	topic   string
-	channel string
-	mode    string
+	handler        benchmark.MessageHandler
+	pubs           []*nsq.Producer
+	next           uint32
+	publishMode    string
+	batchSize      int
+	flushInterval  time.Duration
+	acks           chan *nsq.ProducerTransaction
+	batches        chan []byte
+	stopping       chan bool
+	publishDone    chan bool
+	publishes      *nsqPublishStats
+	deferrals      []time.Duration
+	nextDeferral   uint32
+	maxDeferral    time.Duration
+	deferred       *nsqDeferralStats
+	sub            *nsq.Consumer
+	nsqds          []string
+	lookupd        []string
+	topic          string
+	channel        string
+	concurrency    int
+	requeuePercent float64
+	requeues       *nsqRequeueStats
+	options        map[string]string
+	mode           string
 }
 
-func NewNsq(numberOfMessages int, clientMode string) *Nsq {
+func NewNsq(numberOfMessages int, clientMode string) (*Nsq, error) {
 	topic := getEnv("TOPIC_NAME", "default")
-	channel := "test"
-	conn := getEnv("MQ_CONNECTION_STRING", "localhost:4150")
-	duration, _ := strconv.Atoi(getEnv("TEST_DURATION", "0"))
+	channel := getEnv("NSQ_CHANNEL", "test")
+	// Comma separated nsqd addresses. Producers publish round-robin across
+	// them, consumers connect to all of them unless lookupd is configured.
+	nsqds := strings.Split(getEnv("MQ_CONNECTION_STRING", "localhost:4150"), ",")
+	lookupd := getEnv("NSQ_LOOKUPD_ADDRESSES", "")
+	var env envOptions
+	duration := env.int("TEST_DURATION", "0")
+	maxInFlight := env.int("NSQ_MAX_IN_FLIGHT", "1")
+	concurrency := env.intRange("NSQ_CONCURRENT_HANDLERS", "1", 1, math.MaxInt32)
+	maxAttempts := env.intRange("NSQ_MAX_ATTEMPTS", "5", 0, math.MaxUint16)
+	requeueDelay := env.int("NSQ_REQUEUE_DELAY_MS", "90000")
+	requeuePercent := env.float("NSQ_REQUEUE_PERCENT", "0", 0, 100)
+	publishMode := env.choice("NSQ_PUBLISH_MODE", "async", "async", "sync", "multi", "deferred")
+	deferMs := getEnv("NSQ_DEFER_MS", "1000")
+	batchSize := env.intRange("NSQ_BATCH_SIZE", "100", 1, math.MaxInt32)
+	flushInterval := env.int("NSQ_FLUSH_INTERVAL_MS", "10")
+	if env.err != nil {
+		return nil, env.err
+	}
+	deferrals, err := parseNsqDeferrals(deferMs)
+	if err != nil && publishMode == "deferred" {
+		return nil, err
+	}
 
-	log.Printf("[NSQClient] Connect to %s", conn)
+	log.Printf("[NSQClient] Connect to %s", strings.Join(nsqds, ","))
 
-	sub, _ := nsq.NewConsumer(topic, channel, nsq.NewConfig())
-	pub, _ := nsq.NewProducer(conn, nsq.NewConfig())
+	config := nsq.NewConfig()
+	config.MaxInFlight = maxInFlight
+	config.MaxAttempts = uint16(maxAttempts)
+	config.DefaultRequeueDelay = time.Duration(requeueDelay) * time.Millisecond
+	sub, err := nsq.NewConsumer(topic, channel, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consumer configuration: %s", err)
+	}
+	pubs := make([]*nsq.Producer, len(nsqds))
+	for i, addr := range nsqds {
+		pubs[i], _ = nsq.NewProducer(addr, nsq.NewConfig())
+	}
+
+	var lookupds []string
+	if lookupd != "" {
+		lookupds = strings.Split(lookupd, ",")
+	}
 
 	var handler benchmark.MessageHandler
 
-	handler = &benchmark.AllInOneMessageHandler{
-		NumberOfMessages: numberOfMessages,
-		Timeout:          duration,
-		Latencies:        []float32{},
+	handler = benchmark.NewAllInOneMessageHandler(numberOfMessages, duration)
+
+	n := &Nsq{
+		handler:        handler,
+		pubs:           pubs,
+		publishMode:    publishMode,
+		batchSize:      batchSize,
+		flushInterval:  time.Duration(flushInterval) * time.Millisecond,
+		stopping:       make(chan bool),
+		publishDone:    make(chan bool),
+		publishes:      &nsqPublishStats{latencies: benchmark.NewLatencyHistogram()},
+		deferred:       &nsqDeferralStats{delays: make(map[time.Duration]*nsqDeferralDeviation)},
+		sub:            sub,
+		nsqds:          nsqds,
+		lookupd:        lookupds,
+		topic:          topic,
+		channel:        channel,
+		concurrency:    concurrency,
+		requeuePercent: requeuePercent,
+		requeues: &nsqRequeueStats{
+			failedAt:   make(map[nsq.MessageID]int64),
+			redelivery: benchmark.NewLatencyHistogram(),
+		},
+		options: map[string]string{
+			"MQ_CONNECTION_STRING":    strings.Join(nsqds, ","),
+			"NSQ_LOOKUPD_ADDRESSES":   lookupd,
+			"NSQ_CHANNEL":             channel,
+			"NSQ_MAX_IN_FLIGHT":       strconv.Itoa(maxInFlight),
+			"NSQ_CONCURRENT_HANDLERS": strconv.Itoa(concurrency),
+			"NSQ_MAX_ATTEMPTS":        strconv.Itoa(maxAttempts),
+			"NSQ_REQUEUE_DELAY_MS":    strconv.Itoa(requeueDelay),
+			"NSQ_REQUEUE_PERCENT":     strconv.FormatFloat(requeuePercent, 'f', -1, 64),
+			"NSQ_PUBLISH_MODE":        publishMode,
+			"NSQ_BATCH_SIZE":          strconv.Itoa(batchSize),
+			"NSQ_FLUSH_INTERVAL_MS":   strconv.Itoa(flushInterval),
+			"NSQ_DEFER_MS":            deferMs,
+		},
+		mode: clientMode,
 	}
 
-	return &Nsq{
-		handler: handler,
-		pub:     pub,
-		sub:     sub,
-		topic:   topic,
-		channel: channel,
-		mode:    clientMode,
+	if benchmark.Produces(clientMode) {
+		switch publishMode {
+		case "deferred":
+			n.deferrals = deferrals
+			for _, delay := range n.deferrals {
+				if delay > n.maxDeferral {
+					n.maxDeferral = delay
+				}
+			}
+			log.Printf("[NSQClient] DeferredPublish with deferrals %v", n.deferrals)
+			n.acks = make(chan *nsq.ProducerTransaction, 1024)
+			go n.collectAcks()
+		case "async":
+			n.acks = make(chan *nsq.ProducerTransaction, 1024)
+			go n.collectAcks()
+		case "multi":
+			log.Printf("[NSQClient] MultiPublish batches of %d, flush every %s", batchSize, n.flushInterval)
+			n.batches = make(chan []byte, batchSize)
+			go n.batchPublish()
+		case "sync":
+			close(n.publishDone)
+		}
 	}
+
+	return n, nil
 }
 
-func (n *Nsq) Setup() {
-	if n.mode == "consumer" {
-		n.sub.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
-			n.handler.ReceiveMessage(message.Body)
+// collectAcks records the outcome of every PublishAsync until the channel is
+// closed by Teardown.
+func (n *Nsq) collectAcks() {
+	for transaction := range n.acks {
+		n.publishes.record(transaction.Args[0].(int64), 1, transaction.Error)
+	}
+	close(n.publishDone)
+}
+
+// batchPublish gathers messages from Send and publishes them with MultiPublish
+// once NSQ_BATCH_SIZE is reached or NSQ_FLUSH_INTERVAL_MS has passed. A zero
+// interval flushes by size only.
+func (n *Nsq) batchPublish() {
+	var tick <-chan time.Time
+	if n.flushInterval > 0 {
+		ticker := time.NewTicker(n.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := make([][]byte, 0, n.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		started := time.Now().UnixNano()
+		err := n.producer().MultiPublish(n.topic, batch)
+		n.publishes.record(started, len(batch), err)
+		batch = make([][]byte, 0, n.batchSize)
+	}
+
+	for {
+		select {
+		case message := <-n.batches:
+			batch = append(batch, message)
+			if len(batch) >= n.batchSize {
+				flush()
+			}
+		case <-tick:
+			flush()
+		case <-n.stopping:
+			// Publish what Send has buffered as well, the FINs are among it.
+			for drained := false; !drained; {
+				select {
+				case message := <-n.batches:
+					batch = append(batch, message)
+					if len(batch) >= n.batchSize {
+						flush()
+					}
+				default:
+					drained = true
+				}
+			}
+			flush()
+			close(n.publishDone)
+			return
+		}
+	}
+}
+
+// handleMessage requeues a random NSQ_REQUEUE_PERCENT of first deliveries.
+// Only the successful delivery reaches the benchmark handler. The requeue is
+// sent without backoff: a failed handler would make go-nsq pause the consumer
+// (RDY 0) and throttle the benchmark.
+func (n *Nsq) handleMessage(message *nsq.Message) error {
+	if delay := nsqDeferral(message.Body); delay > 0 && message.Attempts == 1 {
+		deviation := time.Now().UnixNano() - message.Timestamp - int64(delay)
+		n.deferred.record(delay, time.Duration(deviation))
+	}
+	if n.requeuePercent > 0 {
+		if message.Attempts > 1 {
+			n.requeues.redeliver(message.ID)
+		} else if rand.Float64()*100 < n.requeuePercent {
+			n.requeues.fail(message.ID)
+			message.DisableAutoResponse()
+			message.RequeueWithoutBackoff(-1)
 			return nil
-		}))
-		conn := getEnv("MQ_CONNECTION_STRING", "localhost:4150")
-		log.Printf("[NSQClient] Subscribe to %s", conn)
-		n.sub.ConnectToNSQD(conn)
+		}
+	}
+	n.handler.ReceiveMessage(message.Body)
+	return nil
+}
+
+func (n *Nsq) Options() map[string]string {
+	return n.options
+}
+
+func (n *Nsq) PublishLatencies() *benchmark.LatencyHistogram {
+	n.publishes.lock.Lock()
+	defer n.publishes.lock.Unlock()
+	latencies := benchmark.NewLatencyHistogram()
+	latencies.Merge(n.publishes.latencies)
+	return latencies
+}
+
+func (n *Nsq) PublishErrors() int64 {
+	n.publishes.lock.Lock()
+	defer n.publishes.lock.Unlock()
+	return n.publishes.errors
+}
+
+// Stats reports the requeue path and the deferred deliveries of the consumer.
+func (n *Nsq) Stats() *benchmark.DriverStats {
+	if !benchmark.Consumes(n.mode) {
+		return nil
+	}
+	stats := &benchmark.DriverStats{
+		Counters:  make(map[string]int64),
+		Latencies: make(map[string]benchmark.LatencySummary),
+	}
+	if n.requeuePercent > 0 {
+		n.requeues.add(stats)
+	}
+	n.deferred.add(stats)
+	if len(stats.Counters) == 0 {
+		return nil
+	}
+	return stats
+}
+
+func (n *Nsq) Setup() {
+	if benchmark.Consumes(n.mode) {
+		log.Printf("[NSQClient] %d concurrent handlers, requeue %f%% of messages", n.concurrency, n.requeuePercent)
+		n.sub.AddConcurrentHandlers(nsq.HandlerFunc(n.handleMessage), n.concurrency)
+		if len(n.lookupd) > 0 {
+			log.Printf("[NSQClient] Discover nsqd through lookupd %s", strings.Join(n.lookupd, ","))
+			if err := n.sub.ConnectToNSQLookupds(n.lookupd); err != nil {
+				log.Printf("[ERROR] Cannot connect to lookupd %s", err)
+			}
+		} else {
+			log.Printf("[NSQClient] Subscribe to %s", strings.Join(n.nsqds, ","))
+			if err := n.sub.ConnectToNSQDs(n.nsqds); err != nil {
+				log.Printf("[ERROR] Cannot connect to nsqd %s", err)
+			}
+		}
 	}
 }
 
 func (n *Nsq) Teardown() {
+	if benchmark.Consumes(n.mode) {
+		if n.requeuePercent > 0 {
+			n.requeues.log()
+		}
+		n.deferred.log()
+	}
 	n.sub.Stop()
-	n.pub.Stop()
+	if benchmark.Produces(n.mode) {
+		close(n.stopping)
+		// The last batches go out before the producers stop.
+		if n.batches != nil {
+			<-n.publishDone
+		}
+	}
+	// Stopping a producer fails its pending transactions, the ack collector
+	// has to keep running until then.
+	for _, pub := range n.pubs {
+		pub.Stop()
+	}
+	if benchmark.Produces(n.mode) {
+		if n.acks != nil {
+			close(n.acks)
+		}
+		<-n.publishDone
+		n.publishes.log()
+	}
+}
+
+// producer returns the next nsqd producer in round-robin order.
+func (n *Nsq) producer() *nsq.Producer {
+	i := atomic.AddUint32(&n.next, 1)
+	return n.pubs[int(i)%len(n.pubs)]
 }
 
 func (n *Nsq) Send(message []byte) {
-	n.pub.PublishAsync(n.topic, message, nil)
-	//n.pub.Publish(n.topic, message)
+	switch n.publishMode {
+	case "sync":
+		started := time.Now().UnixNano()
+		err := n.producer().Publish(n.topic, message)
+		n.publishes.record(started, 1, err)
+	case "multi":
+		select {
+		case n.batches <- message:
+		case <-n.stopping:
+		}
+	case "deferred":
+		var delay time.Duration
+		header, _ := benchmark.DecodeHeader(message)
+		switch {
+		case header.Flags == 0:
+			i := atomic.AddUint32(&n.nextDeferral, 1)
+			delay = n.deferrals[int(i)%len(n.deferrals)]
+			if !putNsqDeferral(message, delay) {
+				log.Fatalf("[NSQClient] Messages of %d bytes are too small for a deferral", len(message))
+			}
+		case header.Has(benchmark.FlagFin):
+			// FIN must not overtake the data, it waits out the longest deferral.
+			delay = n.maxDeferral
+		}
+		started := time.Now().UnixNano()
+		var err error
+		if delay > 0 {
+			err = n.producer().DeferredPublishAsync(n.topic, delay, message, n.acks, started)
+		} else {
+			err = n.producer().PublishAsync(n.topic, message, n.acks, started)
+		}
+		if err != nil {
+			n.publishes.record(started, 1, err)
+		}
+	default:
+		started := time.Now().UnixNano()
+		if err := n.producer().PublishAsync(n.topic, message, n.acks, started); err != nil {
+			n.publishes.record(started, 1, err)
+		}
+	}
 }
 
 func (n *Nsq) MessageHandler() *benchmark.MessageHandler {
@@ -0,0 +1,93 @@
+package mq
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/go-nsq"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+)
+
+// unreachableNsqd points the driver at a port nobody listens on, every publish
+// fails and is counted as an error.
+func unreachableNsqd(t *testing.T) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	t.Setenv("MQ_CONNECTION_STRING", addr)
+	t.Setenv("TOPIC_NAME", "benchmark")
+	t.Setenv("TEST_DURATION", "0")
+}
+
+// TestNsqMultiPublishTeardown checks that Teardown publishes every buffered
+// message, so none of them goes missing from the counts.
+func TestNsqMultiPublishTeardown(t *testing.T) {
+	for _, interval := range []int{0, 10000} {
+		t.Run("interval="+strconv.Itoa(interval), func(t *testing.T) {
+			unreachableNsqd(t)
+			t.Setenv("NSQ_PUBLISH_MODE", "multi")
+			t.Setenv("NSQ_BATCH_SIZE", "8")
+			t.Setenv("NSQ_FLUSH_INTERVAL_MS", strconv.Itoa(interval))
+
+			n, err := NewNsq(0, "producer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Fewer than a batch, only Teardown can publish them.
+			for i := uint64(1); i <= 5; i++ {
+				n.Send(testMessage(t, i, 0))
+			}
+			n.Teardown()
+
+			if n.publishes.published+n.publishes.errors != 5 {
+				t.Errorf("%d published and %d errors, want 5 messages accounted for",
+					n.publishes.published, n.publishes.errors)
+			}
+		})
+	}
+}
+
+func TestNsqDeferralStats(t *testing.T) {
+	unreachableNsqd(t)
+	n, err := NewNsq(0, "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := n.Stats(); stats != nil {
+		t.Errorf("stats %+v before any deferred message", stats)
+	}
+
+	now := time.Now().UnixNano()
+	for i, deviation := range []time.Duration{-time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond} {
+		message := testMessage(t, uint64(i+1), 0)
+		putNsqDeferral(message, time.Second)
+		n.handleMessage(&nsq.Message{
+			Body:      message,
+			Attempts:  1,
+			Timestamp: now - int64(time.Second) - int64(deviation),
+		})
+	}
+	// Messages without a deferral are left out.
+	n.handleMessage(&nsq.Message{Body: testMessage(t, 3, benchmark.FlagFin), Attempts: 1, Timestamp: now})
+
+	stats := n.Stats()
+	if stats == nil {
+		t.Fatal("no stats")
+	}
+	if stats.Counters["deferred_1s"] != 3 || stats.Counters["deferred_1s_early"] != 1 {
+		t.Errorf("counters %v, want 3 deferred and 1 early", stats.Counters)
+	}
+	deviation := stats.Latencies["deferral_deviation_1s"]
+	if deviation.Count != 3 || deviation.Min != 0 || deviation.Max < 10 || deviation.Max > 20 {
+		t.Errorf("deviation %s, want 3 from 0 to about 10 ms", deviation)
+	}
+	if len(stats.Notes) != 1 {
+		t.Errorf("notes %v, want the clock note", stats.Notes)
+	}
+}
@@ -0,0 +1,224 @@
+package mq
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+)
+
+const redisPayloadField = "m"
+
+func redisAddress() string {
+	return getEnv("MQ_CONNECTION_STRING", "localhost:6379")
+}
+
+func newRedisClient(prefix string) (*redis.Client, error) {
+	conn := redisAddress()
+	log.Printf("[%s] Connect to %s", prefix, conn)
+
+	client := redis.NewClient(&redis.Options{Addr: conn})
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("cannot connect: %s", err)
+	}
+	return client, nil
+}
+
+// RedisStreams publishes with XADD and consumes through a consumer group with
+// XREADGROUP, acknowledging each batch with XACK.
+type RedisStreams struct {
+	handler   benchmark.MessageHandler
+	client    *redis.Client
+	stream    string
+	group     string
+	consumer  string
+	maxLen    int64
+	readCount int64
+	done      chan bool
+	mode      string
+}
+
+func NewRedisStreams(numberOfMessages int, clientMode string) (*RedisStreams, error) {
+	hostname, _ := os.Hostname()
+	var env envOptions
+	maxLen := env.int("REDIS_STREAM_MAXLEN", "0")
+	readCount := env.intRange("REDIS_READ_COUNT", "100", 1, math.MaxInt32)
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+	client, err := newRedisClient("RedisStreamsClient")
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisStreams{
+		handler:   benchmark.NewAllInOneMessageHandler(numberOfMessages, duration),
+		client:    client,
+		stream:    getEnv("TOPIC_NAME", "default"),
+		group:     getEnv("REDIS_CONSUMER_GROUP", "test"),
+		consumer:  getEnv("REDIS_CONSUMER_NAME", hostname),
+		maxLen:    int64(maxLen),
+		readCount: int64(readCount),
+		done:      make(chan bool),
+		mode:      clientMode,
+	}, nil
+}
+
+func (r *RedisStreams) Options() map[string]string {
+	return map[string]string{
+		"MQ_CONNECTION_STRING": redisAddress(),
+		"REDIS_CONSUMER_GROUP": r.group,
+		"REDIS_CONSUMER_NAME":  r.consumer,
+		"REDIS_READ_COUNT":     strconv.FormatInt(r.readCount, 10),
+		"REDIS_STREAM_MAXLEN":  strconv.FormatInt(r.maxLen, 10),
+	}
+}
+
+func (r *RedisStreams) Setup() {
+	if benchmark.Consumes(r.mode) {
+		// "$" only delivers entries added after the group is created. The group
+		// may already exist from an earlier run, which is fine.
+		err := r.client.XGroupCreateMkStream(r.stream, r.group, "$").Err()
+		if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+			log.Fatalf("[RedisStreamsClient] Cannot create group %s: %s", r.group, err)
+		}
+		log.Printf("[RedisStreamsClient] Subscribe to %s as %s/%s", r.stream, r.group, r.consumer)
+		go r.receive()
+	}
+}
+
+func (r *RedisStreams) receive() {
+	args := &redis.XReadGroupArgs{
+		Group:    r.group,
+		Consumer: r.consumer,
+		Streams:  []string{r.stream, ">"},
+		Count:    r.readCount,
+		Block:    time.Second,
+	}
+	for {
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+
+		streams, err := r.client.XReadGroup(args).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			log.Printf("[RedisStreamsClient] XREADGROUP error: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, stream := range streams {
+			ids := make([]string, 0, len(stream.Messages))
+			for _, message := range stream.Messages {
+				payload, _ := message.Values[redisPayloadField].(string)
+				r.handler.ReceiveMessage([]byte(payload))
+				ids = append(ids, message.ID)
+			}
+			if len(ids) > 0 {
+				r.client.XAck(r.stream, r.group, ids...)
+			}
+		}
+	}
+}
+
+func (r *RedisStreams) Teardown() {
+	close(r.done)
+	r.client.Close()
+}
+
+func (r *RedisStreams) Send(message []byte) {
+	err := r.client.XAdd(&redis.XAddArgs{
+		Stream:       r.stream,
+		MaxLenApprox: r.maxLen,
+		Values:       map[string]interface{}{redisPayloadField: message},
+	}).Err()
+	if err != nil {
+		log.Printf("[RedisStreamsClient] XADD error: %s", err)
+		metrics.PublishErrors.Inc()
+	}
+}
+
+func (r *RedisStreams) MessageHandler() *benchmark.MessageHandler {
+	return &r.handler
+}
+
+// RedisPubSub uses plain PUBLISH/SUBSCRIBE, which has no persistence and drops
+// messages for slow or absent subscribers.
+type RedisPubSub struct {
+	handler benchmark.MessageHandler
+	client  *redis.Client
+	sub     *redis.PubSub
+	channel string
+	mode    string
+}
+
+func NewRedisPubSub(numberOfMessages int, clientMode string) (*RedisPubSub, error) {
+	var env envOptions
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+	client, err := newRedisClient("RedisPubSubClient")
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisPubSub{
+		handler: benchmark.NewAllInOneMessageHandler(numberOfMessages, duration),
+		client:  client,
+		channel: getEnv("TOPIC_NAME", "default"),
+		mode:    clientMode,
+	}, nil
+}
+
+func (r *RedisPubSub) Options() map[string]string {
+	return map[string]string{
+		"MQ_CONNECTION_STRING": redisAddress(),
+	}
+}
+
+func (r *RedisPubSub) Setup() {
+	if benchmark.Consumes(r.mode) {
+		r.sub = r.client.Subscribe(r.channel)
+		if _, err := r.sub.Receive(); err != nil {
+			log.Fatalf("[RedisPubSubClient] Cannot subscribe to %s: %s", r.channel, err)
+		}
+		log.Printf("[RedisPubSubClient] Subscribe to %s", r.channel)
+
+		go func() {
+			for message := range r.sub.Channel() {
+				r.handler.ReceiveMessage([]byte(message.Payload))
+			}
+		}()
+	}
+}
+
+func (r *RedisPubSub) Teardown() {
+	if r.sub != nil {
+		r.sub.Close()
+	}
+	r.client.Close()
+}
+
+func (r *RedisPubSub) Send(message []byte) {
+	if err := r.client.Publish(r.channel, message).Err(); err != nil {
+		log.Printf("[RedisPubSubClient] PUBLISH error: %s", err)
+		metrics.PublishErrors.Inc()
+	}
+}
+
+func (r *RedisPubSub) MessageHandler() *benchmark.MessageHandler {
+	return &r.handler
+}
@@ -0,0 +1,79 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// runMiniredis starts an in-process Redis stand-in and points the drivers at it.
+func runMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+	t.Setenv("MQ_CONNECTION_STRING", server.Addr())
+	t.Setenv("TOPIC_NAME", "benchmark")
+	t.Setenv("TEST_DURATION", "0")
+	return server
+}
+
+func TestRedisStreams(t *testing.T) {
+	server := runMiniredis(t)
+	t.Setenv("REDIS_CONSUMER_GROUP", "workers")
+	t.Setenv("REDIS_CONSUMER_NAME", "consumer-1")
+
+	r, err := NewRedisStreams(0, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Setup()
+	defer r.Teardown()
+	sendAndReceive(t, r, *r.MessageHandler())
+
+	entries, err := server.Stream("benchmark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("stream holds %d entries, want 4", len(entries))
+	}
+	// Every entry read through the group has been acknowledged.
+	pending, err := r.client.XPending("benchmark", "workers").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Errorf("%d entries pending, want all acknowledged", pending.Count)
+	}
+}
+
+func TestRedisStreamsExistingGroup(t *testing.T) {
+	server := runMiniredis(t)
+	t.Setenv("REDIS_CONSUMER_GROUP", "workers")
+	// A group left over from an earlier run is reused.
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	if err := client.XGroupCreateMkStream("benchmark", "workers", "$").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRedisStreams(0, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Setup()
+	defer r.Teardown()
+	sendAndReceive(t, r, *r.MessageHandler())
+}
+
+func TestRedisPubSub(t *testing.T) {
+	runMiniredis(t)
+
+	r, err := NewRedisPubSub(0, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Setup()
+	defer r.Teardown()
+	sendAndReceive(t, r, *r.MessageHandler())
+}
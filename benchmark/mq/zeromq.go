@@ -1,53 +1,283 @@
 package mq
 
 import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"github.com/pebbe/zmq4"
+
 	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+	"github.com/pebbe/zmq4"
 )
 
+// Socket pair used by each ZMQ_PATTERN. The producer binds and the consumer
+// connects, except for "proxy" where both connect to a proxy started with
+// CLIENT_MODE=proxy.
+var zeromqPatterns = map[string][2]zmq4.Type{
+	"pubsub":       {zmq4.PUB, zmq4.SUB},
+	"pushpull":     {zmq4.PUSH, zmq4.PULL},
+	"dealerrouter": {zmq4.DEALER, zmq4.ROUTER},
+	"proxy":        {zmq4.PUB, zmq4.SUB},
+}
+
+// Socket options read from the environment. Unset options keep the libzmq
+// default, the effective value of every option is logged either way.
+var zeromqSocketOptions = []struct {
+	env string
+	set func(*zmq4.Socket, int) error
+	get func(*zmq4.Socket) (int, error)
+}{
+	{"ZMQ_SNDHWM", (*zmq4.Socket).SetSndhwm, (*zmq4.Socket).GetSndhwm},
+	{"ZMQ_RCVHWM", (*zmq4.Socket).SetRcvhwm, (*zmq4.Socket).GetRcvhwm},
+	{"ZMQ_SNDBUF", (*zmq4.Socket).SetSndbuf, (*zmq4.Socket).GetSndbuf},
+	{"ZMQ_RCVBUF", (*zmq4.Socket).SetRcvbuf, (*zmq4.Socket).GetRcvbuf},
+	{"ZMQ_LINGER_MS", setZeromqLinger, getZeromqLinger},
+	{"ZMQ_TCP_KEEPALIVE", (*zmq4.Socket).SetTcpKeepalive, (*zmq4.Socket).GetTcpKeepalive},
+	{"ZMQ_TCP_KEEPALIVE_IDLE", (*zmq4.Socket).SetTcpKeepaliveIdle, (*zmq4.Socket).GetTcpKeepaliveIdle},
+}
+
+func setZeromqLinger(socket *zmq4.Socket, ms int) error {
+	if ms < 0 {
+		return socket.SetLinger(-1)
+	}
+	return socket.SetLinger(time.Duration(ms) * time.Millisecond)
+}
+
+func getZeromqLinger(socket *zmq4.Socket) (int, error) {
+	linger, err := socket.GetLinger()
+	if linger < 0 {
+		return -1, err
+	}
+	return int(linger / time.Millisecond), err
+}
+
+// zeromqOptionsFromEnv reads the socket options that are set.
+func zeromqOptionsFromEnv() (map[string]int, error) {
+	options := make(map[string]int)
+	for _, option := range zeromqSocketOptions {
+		if value, exists := os.LookupEnv(option.env); exists {
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an integer, got %q", option.env, value)
+			}
+			options[option.env] = v
+		}
+	}
+	return options, nil
+}
+
+// applyZeromqOptions sets the configured options on socket and returns the
+// effective value of each of them.
+func applyZeromqOptions(socket *zmq4.Socket, configured map[string]int) map[string]int {
+	options := make(map[string]int)
+	for _, option := range zeromqSocketOptions {
+		if v, exists := configured[option.env]; exists {
+			if err := option.set(socket, v); err != nil {
+				log.Printf("[ZeroMQClient] Cannot set %s: %s", option.env, err)
+			}
+		}
+		if v, err := option.get(socket); err == nil {
+			options[option.env] = v
+		}
+	}
+	return options
+}
+
 type Zeromq struct {
 	handler  benchmark.MessageHandler
 	sender   *zmq4.Socket
 	receiver *zmq4.Socket
+	sendLock sync.Mutex
+	pattern  string
+	conn     string
+	topic    string
+	filter   string
+	options  map[string]int
+	sent     int64
+	dropped  int64
+	done     chan bool
+	stopped  chan bool
 }
 
+// zeromqPollInterval bounds how long the receive loop blocks before checking
+// for teardown.
+const zeromqPollInterval = 100 * time.Millisecond
+
 func zeromqReceive(zeromq *Zeromq) {
+	defer close(zeromq.stopped)
+
+	poller := zmq4.NewPoller()
+	poller.Add(zeromq.receiver, zmq4.POLLIN)
 	for {
-		// TODO: Some messages come back empty. Is this a slow-consumer problem?
-		// Should DONTWAIT be used?
-		message, _ := zeromq.receiver.RecvBytes(zmq4.DONTWAIT)
-		if zeromq.handler.ReceiveMessage(message) {
-			break
+		select {
+		case <-zeromq.done:
+			return
+		default:
+		}
+
+		polled, err := poller.Poll(zeromqPollInterval)
+		if err != nil {
+			// Interrupted system calls are expected, keep polling.
+			log.Printf("[ZeroMQClient] Poll error: %s", err)
+			continue
+		}
+		if len(polled) == 0 {
+			continue
+		}
+
+		// Drain everything that is queued before polling again.
+		for {
+			frames, err := zeromq.receiver.RecvMessageBytes(zmq4.DONTWAIT)
+			if err != nil {
+				break
+			}
+			// ROUTER prepends the peer identity, the payload is always the last frame.
+			message := frames[len(frames)-1]
+			if len(message) == 0 {
+				continue
+			}
+			if zeromq.handler.ReceiveMessage(message) {
+				return
+			}
 		}
 	}
 }
 
-func NewZeromq(numberOfMessages int, clientMode string) *Zeromq {
+func NewZeromq(numberOfMessages int, clientMode string) (*Zeromq, error) {
+	var env envOptions
+	pattern := env.choice("ZMQ_PATTERN", "pubsub", "pubsub", "pushpull", "dealerrouter", "proxy")
+	duration := env.int("TEST_DURATION", "0")
+	if env.err != nil {
+		return nil, env.err
+	}
+	sockets := zeromqPatterns[pattern]
+	configured, err := zeromqOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, _ := zmq4.NewContext()
-	pub, _ := ctx.NewSocket(zmq4.PUB)
-	sub, _ := ctx.NewSocket(zmq4.SUB)
-	if clientMode == "consumer" {
-		sub.Connect(getEnv("MQ_CONNECTION_STRING", "tcp://localhost:5555"))
-	} else {
-		pub.Bind(getEnv("MQ_CONNECTION_STRING", "tcp://*5555"))
+	zeromq := &Zeromq{
+		pattern: pattern,
+		done:    make(chan bool),
+		stopped: make(chan bool),
 	}
+	if benchmark.Produces(clientMode) {
+		zeromq.sender, _ = ctx.NewSocket(sockets[0])
+		zeromq.options = applyZeromqOptions(zeromq.sender, configured)
+		// Subscription filters match the first frame, so a topic is sent as a
+		// frame of its own ahead of the payload.
+		zeromq.topic = getEnv("ZMQ_TOPIC", "")
+		if pattern == "proxy" {
+			conn := getEnv("MQ_CONNECTION_STRING", "tcp://localhost:5555")
+			log.Printf("[ZeroMQClient] Connect %s socket to %s", sockets[0], conn)
+			zeromq.conn = conn
+			zeromq.sender.Connect(conn)
+		} else {
+			conn := getEnv("MQ_CONNECTION_STRING", "tcp://*:5555")
+			log.Printf("[ZeroMQClient] Bind %s socket to %s", sockets[0], conn)
+			zeromq.conn = conn
+			zeromq.sender.Bind(conn)
+		}
+	}
+	if benchmark.Consumes(clientMode) {
+		conn := getEnv("MQ_CONNECTION_STRING", "tcp://localhost:5555")
+		if pattern == "proxy" {
+			// Subscribers read from the XPUB backend, the frontend only takes
+			// publishers.
+			conn = getEnv("MQ_CONNECTION_STRING", zeromqLocalAddress(getEnv("ZMQ_PROXY_BACKEND", "tcp://*:5556")))
+		}
+		if zeromq.sender != nil {
+			// Both ends in one process: connect to the address the sender
+			// bound, or to the backend of the proxy.
+			conn = zeromqLocalAddress(zeromq.conn)
+			if pattern == "proxy" {
+				conn = zeromqLocalAddress(getEnv("ZMQ_PROXY_BACKEND", "tcp://*:5556"))
+			}
+		}
+		log.Printf("[ZeroMQClient] Connect %s socket to %s", sockets[1], conn)
+		if zeromq.conn == "" {
+			zeromq.conn = conn
+		}
+		zeromq.receiver, _ = ctx.NewSocket(sockets[1])
+		zeromq.options = applyZeromqOptions(zeromq.receiver, configured)
+		if sockets[1] == zmq4.SUB {
+			// An empty filter subscribes to everything.
+			zeromq.filter = getEnv("ZMQ_SUBSCRIBE", "")
+			log.Printf("[ZeroMQClient] Subscribe to %q", zeromq.filter)
+			zeromq.receiver.SetSubscribe(zeromq.filter)
+		}
+		zeromq.receiver.Connect(conn)
+	}
+
+	log.Printf("[ZeroMQClient] Socket options: %s", formatZeromqOptions(zeromq.options))
 
-	var handler benchmark.MessageHandler
+	zeromq.handler = benchmark.NewAllInOneMessageHandler(numberOfMessages, duration)
+
+	return zeromq, nil
+}
 
-	duration, _ := strconv.Atoi(getEnv("TEST_DURATION", "0"))
-	handler = &benchmark.AllInOneMessageHandler{
-		NumberOfMessages: numberOfMessages,
-		Timeout: duration,
-		Latencies: []float32{},
+// Options reports the pattern and the effective socket options.
+func (zeromq *Zeromq) Options() map[string]string {
+	options := map[string]string{
+		"ZMQ_PATTERN":          zeromq.pattern,
+		"MQ_CONNECTION_STRING": zeromq.conn,
+		"ZMQ_TOPIC":            zeromq.topic,
+		"ZMQ_SUBSCRIBE":        zeromq.filter,
 	}
+	for key, value := range zeromq.options {
+		options[key] = strconv.Itoa(value)
+	}
+	return options
+}
+
+// zeromqLocalAddress turns a bind address such as tcp://*:5555 into one that
+// can be connected to from the same host.
+func zeromqLocalAddress(addr string) string {
+	return strings.Replace(addr, "*", "localhost", 1)
+}
 
-	return &Zeromq{
-		handler:  handler,
-		sender:   pub,
-		receiver: sub,
+func formatZeromqOptions(options map[string]int) string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = fmt.Sprintf("%s=%d", key, options[key])
+	}
+	return strings.Join(values, " ")
+}
+
+// RunZeromqProxy forwards everything published to the XSUB frontend to the
+// subscribers of the XPUB backend. It only returns when the proxy fails.
+func RunZeromqProxy() {
+	frontendAddr := getEnv("ZMQ_PROXY_FRONTEND", "tcp://*:5555")
+	backendAddr := getEnv("ZMQ_PROXY_BACKEND", "tcp://*:5556")
+
+	ctx, _ := zmq4.NewContext()
+	frontend, _ := ctx.NewSocket(zmq4.XSUB)
+	backend, _ := ctx.NewSocket(zmq4.XPUB)
+	defer frontend.Close()
+	defer backend.Close()
+
+	if err := frontend.Bind(frontendAddr); err != nil {
+		log.Fatalf("[ZeroMQProxy] Cannot bind frontend %s: %s", frontendAddr, err)
+	}
+	if err := backend.Bind(backendAddr); err != nil {
+		log.Fatalf("[ZeroMQProxy] Cannot bind backend %s: %s", backendAddr, err)
+	}
+
+	log.Printf("[ZeroMQProxy] Forward %s (XSUB) to %s (XPUB)", frontendAddr, backendAddr)
+	err := zmq4.Proxy(frontend, backend, nil)
+	log.Printf("[ZeroMQProxy] Stopped: %s", err)
 }
 
 func (zeromq *Zeromq) Setup() {
@@ -57,13 +287,54 @@ func (zeromq *Zeromq) Setup() {
 }
 
 func (zeromq *Zeromq) Teardown() {
-	zeromq.sender.Close()
-	zeromq.receiver.Close()
+	if zeromq.sender != nil {
+		// PUB drops silently at the high-water mark, the other patterns fail
+		// the non-blocking send and end up here.
+		log.Printf("[ZeroMQClient] Sent %d messages, dropped %d on send", zeromq.sent, zeromq.dropped)
+		zeromq.sender.Close()
+	}
+	if zeromq.receiver != nil {
+		// The receive loop owns the socket until it has returned.
+		close(zeromq.done)
+		<-zeromq.stopped
+		zeromq.receiver.Close()
+	}
 }
 
 func (zeromq *Zeromq) Send(message []byte) {
+	// Sockets are not thread safe and Send is called from several goroutines.
+	zeromq.sendLock.Lock()
+	defer zeromq.sendLock.Unlock()
 	// TODO: Should DONTWAIT be used? Possibly overloading consumer.
-	zeromq.sender.SendBytes(message, zmq4.DONTWAIT)
+	var err error
+	if zeromq.topic != "" {
+		_, err = zeromq.sender.SendMessageDontwait(zeromq.topic, message)
+	} else {
+		_, err = zeromq.sender.SendBytes(message, zmq4.DONTWAIT)
+	}
+	if err != nil {
+		zeromq.dropped++
+		metrics.PublishErrors.Inc()
+		return
+	}
+	zeromq.sent++
+}
+
+// Stats reports how many messages the socket took and how many it refused.
+func (zeromq *Zeromq) Stats() *benchmark.DriverStats {
+	if zeromq.sender == nil {
+		return nil
+	}
+	zeromq.sendLock.Lock()
+	defer zeromq.sendLock.Unlock()
+	stats := &benchmark.DriverStats{
+		Counters: map[string]int64{"sent": zeromq.sent, "dropped": zeromq.dropped},
+	}
+	if zeromq.pattern == "pubsub" || zeromq.pattern == "proxy" {
+		stats.Notes = append(stats.Notes, "PUB drops at the high-water mark without an error: such drops are "+
+			"counted in sent, not dropped, and only show up as lost sequences on the consumer")
+	}
+	return stats
 }
 
 func (zeromq *Zeromq) MessageHandler() *benchmark.MessageHandler {
@@ -1,13 +1,14 @@
 package benchmark
 
 import (
-	"encoding/binary"
 	"fmt"
 	"log"
-	"os"
-	"strings"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
 )
 
 type MessageReceiver interface {
@@ -43,13 +44,52 @@ type MessageHandler interface {
 type AllInOneMessageHandler struct {
 	NumberOfMessages int
 	Timeout          int
-	Latencies        []float32
-	messageCounter   int
-	hasStarted       bool
-	hasCompleted     bool
-	started          int64
-	stopped          int64
-	completionLock   sync.Mutex
+	// Producers is how many producers must finish before the handler
+	// completes, PRODUCER_COUNT. With 0 every producer seen must finish.
+	Producers int
+	// Latencies are measured from the actual send time (service latency),
+	// ResponseLatencies from the intended send time of the rate schedule.
+	Latencies         *LatencyHistogram
+	ResponseLatencies *LatencyHistogram
+	messageCounter    int
+	byteCounter       int64
+	invalidCounter    int
+	sequences         map[uint32]*sequenceTracker
+	trace             *TraceWriter
+	recorder          *windowRecorder
+	windows           []Window
+	hasStarted        bool
+	hasCompleted      bool
+	started           int64
+	stopped           int64
+	lock              sync.Mutex
+	completionLock    sync.Mutex
+
+	// clocks hold the latest clock estimate per producer when
+	// CLOCK_SYNC_LISTEN is set, see ServeClockSync.
+	syncClocks       bool
+	clocks           map[uint32]ClockEstimate
+	clockUncorrected int64
+	clockIgnored     int64
+}
+
+func NewAllInOneMessageHandler(numberOfMessages int, timeout int) *AllInOneMessageHandler {
+	return &AllInOneMessageHandler{
+		NumberOfMessages:  numberOfMessages,
+		Timeout:           timeout,
+		Latencies:         NewLatencyHistogram(),
+		ResponseLatencies: NewLatencyHistogram(),
+		Producers:         producerCount(),
+		trace:             newTraceFromEnv(),
+		recorder:          newWindowRecorder(true),
+		syncClocks:        getEnv("CLOCK_SYNC_LISTEN", "") != "",
+	}
+}
+
+// producerCount reads PRODUCER_COUNT, main rejects invalid values.
+func producerCount() int {
+	count, _ := strconv.Atoi(getEnv("PRODUCER_COUNT", "0"))
+	return count
 }
 
 func (handler *AllInOneMessageHandler) HasCompleted() bool {
@@ -59,8 +99,30 @@ func (handler *AllInOneMessageHandler) HasCompleted() bool {
 }
 
 // Merge Latency and Throughput to a single handler + write report to file
+// Drivers may call it from several goroutines at once.
 func (handler *AllInOneMessageHandler) ReceiveMessage(message []byte) bool {
 	now := time.Now().UnixNano()
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.HasCompleted() {
+		return true
+	}
+
+	header, err := DecodeHeader(message)
+	if err != nil {
+		handler.invalidCounter++
+		metrics.InvalidMessages.Inc()
+		return false
+	}
+	if header.Has(FlagControl) {
+		handler.control(header, Payload(message))
+		return false
+	}
+	// Warmup messages are not part of the results.
+	if header.Has(FlagWarmup) {
+		return false
+	}
+
 	if !handler.hasStarted {
 		handler.hasStarted = true
 		handler.started = time.Now().UnixNano()
@@ -70,26 +132,127 @@ func (handler *AllInOneMessageHandler) ReceiveMessage(message []byte) bool {
 	}
 	// Update message counter
 	handler.messageCounter++
+	handler.byteCounter += int64(len(message))
+	metrics.MessagesReceived.Inc()
+	metrics.BytesReceived.Add(float64(len(message)))
 
-	// Record latency
-	then, _ := binary.Varint(message[0:9]) // First 8 bytes is sending time
-	fin, _ := binary.Varint(message[9:18]) // FIN
+	// Track loss, duplicates and ordering per producer
+	if handler.sequences == nil {
+		handler.sequences = make(map[uint32]*sequenceTracker)
+	}
+	tracker, ok := handler.sequences[header.ProducerID]
+	if !ok {
+		tracker = &sequenceTracker{}
+		handler.sequences[header.ProducerID] = tracker
+	}
+	if header.Has(FlagFin) {
+		tracker.fin(header.Sequence)
+	} else {
+		tracker.record(header.Sequence)
+	}
+
+	// Move the producer times onto the consumer clock
+	var offset int64
+	if clock, ok := handler.clocks[header.ProducerID]; ok {
+		offset = clock.offsetAt(header.SendTime)
+	} else if handler.syncClocks {
+		handler.clockUncorrected++
+	}
+	sendTime := header.SendTime + offset
+	intendedTime := header.IntendedTime + offset
 
-	if then != 0 {
-		handler.Latencies = append(handler.Latencies, (float32(now-then))/1000000.0)
+	// Record latency
+	handler.Latencies.Record(time.Duration(now - sendTime))
+	metrics.Latency.Observe(time.Duration(now - sendTime).Seconds())
+	handler.ResponseLatencies.Record(time.Duration(now - intendedTime))
+	handler.recorder.record(now, len(message), time.Duration(now-sendTime))
+	if handler.trace != nil {
+		handler.trace.Write(TraceRecord{
+			ProducerID:   header.ProducerID,
+			Sequence:     header.Sequence,
+			Flags:        header.Flags,
+			Size:         len(message),
+			IntendedTime: header.IntendedTime,
+			SendTime:     header.SendTime,
+			ReceiveTime:  now,
+			ClockOffset:  offset,
+		})
 	}
 
-	if fin != 0 {
-		handler.stopped = time.Now().UnixNano()
-		handler.WriteReport()
-		handler.completionLock.Lock()
-		handler.hasCompleted = true
-		handler.completionLock.Unlock()
+	if handler.producersDone() {
+		handler.complete()
 		return true
 	}
 	return false
 }
 
+// producersDone tells whether every producer seen has sent its FIN or
+// delivered NumberOfMessages distinct messages, and at least Producers of
+// them have been seen. Callers must hold handler.lock.
+func (handler *AllInOneMessageHandler) producersDone() bool {
+	if len(handler.sequences) < handler.Producers {
+		return false
+	}
+	for _, tracker := range handler.sequences {
+		countReached := handler.NumberOfMessages > 0 && tracker.received >= uint64(handler.NumberOfMessages)
+		if !tracker.finished() && !countReached {
+			return false
+		}
+	}
+	return true
+}
+
+// control handles a FlagControl message. Callers must hold handler.lock.
+func (handler *AllInOneMessageHandler) control(header Header, payload []byte) {
+	estimate, err := decodeClockEstimate(payload)
+	if err != nil {
+		handler.invalidCounter++
+		metrics.InvalidMessages.Inc()
+		return
+	}
+	if handler.clocks == nil {
+		handler.clocks = make(map[uint32]ClockEstimate)
+	}
+	current, ok := handler.clocks[header.ProducerID]
+	if !ok {
+		log.Printf("Clock of producer %d: %s", header.ProducerID, estimate)
+	} else if estimate.Reference < current.Reference {
+		// The broker reordered the estimates, keep the newer one.
+		handler.clockIgnored++
+		return
+	}
+	handler.clocks[header.ProducerID] = estimate
+}
+
+// clockMissing lists the producers that sent messages but no clock estimate.
+func (handler *AllInOneMessageHandler) clockMissing() []uint32 {
+	if !handler.syncClocks {
+		return nil
+	}
+	var missing []uint32
+	for id := range handler.sequences {
+		if _, ok := handler.clocks[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	return missing
+}
+
+// Stop the clock, write the report and mark the handler complete. Callers must
+// hold handler.lock.
+func (handler *AllInOneMessageHandler) complete() {
+	handler.stopped = time.Now().UnixNano()
+	handler.windows = handler.recorder.finish(handler.stopped)
+	if handler.trace != nil {
+		handler.trace.Close()
+	}
+	handler.WriteReport()
+	handler.completionLock.Lock()
+	handler.hasCompleted = true
+	handler.completionLock.Unlock()
+}
+
 func (endpoint ReceiveEndpoint) WaitForCompletion() {
 	for {
 		if (*endpoint.Handler).HasCompleted() {
@@ -105,37 +268,114 @@ func (handler *AllInOneMessageHandler) SetTimer() {
 	log.Printf("Set consumer timeout: %d ms", handler.Timeout)
 	go func() {
 		<-time.After(time.Duration(handler.Timeout) * time.Millisecond)
-		handler.stopped = time.Now().UnixNano()
-		handler.WriteReport()
-		handler.completionLock.Lock()
-		handler.hasCompleted = true
-		handler.completionLock.Unlock()
+		handler.lock.Lock()
+		defer handler.lock.Unlock()
+		if !handler.HasCompleted() {
+			handler.complete()
+		}
 	}()
 }
 
+// DeliveryStats sums up the delivery of all producers seen so far.
+func (handler *AllInOneMessageHandler) DeliveryStats() DeliveryStats {
+	total := DeliveryStats{}
+	for _, tracker := range handler.sequences {
+		total = total.add(tracker.stats())
+	}
+	return total
+}
+
+// Result collects the consumer side of the JSON report.
+func (handler *AllInOneMessageHandler) Result() *ConsumerResult {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	producers := make(map[uint32]DeliveryStats, len(handler.sequences))
+	for id, tracker := range handler.sequences {
+		producers[id] = tracker.stats()
+	}
+	started := time.Unix(0, handler.started)
+	stopped := time.Unix(0, handler.stopped)
+	result := &ConsumerResult{
+		Started:                   started,
+		Stopped:                   stopped,
+		Messages:                  handler.messageCounter,
+		Bytes:                     handler.byteCounter,
+		Invalid:                   handler.invalidCounter,
+		Throughput:                throughput(handler.messageCounter, started, stopped),
+		Delivery:                  handler.DeliveryStats(),
+		Producers:                 producers,
+		Latency:                   handler.Latencies.Summary(),
+		ResponseLatency:           handler.ResponseLatencies.Summary(),
+		LatencyHistogram:          handler.Latencies,
+		ResponseLatencyHistogram:  handler.ResponseLatencies,
+		NegativeLatencies:         handler.Latencies.Negative,
+		OverflowLatencies:         handler.Latencies.Overflow,
+		ResponseNegativeLatencies: handler.ResponseLatencies.Negative,
+		ResponseOverflowLatencies: handler.ResponseLatencies.Overflow,
+		Windows:                   handler.windows,
+		ClockUncorrected:          handler.clockUncorrected,
+		ClockIgnored:              handler.clockIgnored,
+		ClockMissing:              handler.clockMissing(),
+	}
+	if len(handler.clocks) > 0 {
+		result.Clocks = make(map[uint32]ClockEstimate, len(handler.clocks))
+		for id, estimate := range handler.clocks {
+			result.Clocks[id] = estimate
+		}
+	}
+	if handler.trace != nil {
+		result.Trace = handler.trace.Result()
+	}
+	return result
+}
+
 func (handler *AllInOneMessageHandler) WriteReport() {
 	ms := float32(handler.stopped-handler.started) / 1000000.0
 	fmt.Printf("\n\n")
 	log.Printf("Received %d messages in %f ms\n", handler.messageCounter, ms)
 	log.Printf("Throughput %f msg per second\n", float32(handler.messageCounter*1000)/ms)
-
-	sum := float32(0)
-	for _, latency := range handler.Latencies {
-		sum += latency
+	delivery := handler.DeliveryStats()
+	log.Printf("Lost %d of %d messages (%f%%)\n", delivery.Lost, delivery.Expected, delivery.LossRate()*100)
+	log.Printf("Duplicates %d (%f%%), out of order %d (%f%%)\n", delivery.Duplicates, delivery.DuplicateRate()*100,
+		delivery.Reordered, delivery.ReorderRate()*100)
+	if len(handler.sequences) > 1 {
+		for id, tracker := range handler.sequences {
+			producer := tracker.stats()
+			log.Printf("Producer %d: lost %d, duplicates %d, out of order %d\n", id,
+				producer.Lost, producer.Duplicates, producer.Reordered)
+		}
 	}
-	avgLatency := float32(sum) / float32(len(handler.Latencies))
-
-	// Write report.csv
-	file, err := os.Create("/var/log/mq_latency.csv")
-	if err != nil {
-		log.Fatal("Cannot create file")
+	if handler.invalidCounter > 0 {
+		log.Printf("Discarded %d messages without a valid header\n", handler.invalidCounter)
+	}
+	if handler.trace != nil && handler.trace.Dropped() > 0 {
+		log.Printf("Trace buffer full or not writable, %d messages missing from %s\n", handler.trace.Dropped(), handler.trace.Path)
 	}
-	defer file.Close()
-
-	latencies := strings.Trim(strings.Join(strings.Fields(fmt.Sprint(handler.Latencies)), ","), "[]")
 
-	file.WriteString(latencies)
+	for id, estimate := range handler.clocks {
+		log.Printf("Clock of producer %d: %s\n", id, estimate)
+	}
+	if handler.clockUncorrected > 0 {
+		log.Printf("%d messages arrived before the clock estimate of their producer, their latency is uncorrected\n",
+			handler.clockUncorrected)
+	}
+	if handler.clockIgnored > 0 {
+		log.Printf("Ignored %d clock estimates that arrived after a newer one\n", handler.clockIgnored)
+	}
+	if missing := handler.clockMissing(); len(missing) > 0 {
+		log.Printf("[ERROR] No clock estimate from producers %v, their latency is uncorrected\n", missing)
+	}
 
-	log.Printf("Mean latency for %d messages: %f ms\n", handler.messageCounter,
-		avgLatency)
+	summary := handler.Latencies.Summary()
+	log.Printf("Latency for %d messages: %s\n", summary.Count, summary)
+	log.Printf("Response latency (from intended send time): %s\n", handler.ResponseLatencies.Summary())
+	if handler.Latencies.Negative > 0 || handler.Latencies.Overflow > 0 {
+		log.Printf("Latency below zero %d, above histogram maximum %d\n",
+			handler.Latencies.Negative, handler.Latencies.Overflow)
+	}
+	if handler.ResponseLatencies.Negative > 0 || handler.ResponseLatencies.Overflow > 0 {
+		log.Printf("Response latency below zero %d, above histogram maximum %d\n",
+			handler.ResponseLatencies.Negative, handler.ResponseLatencies.Overflow)
+	}
 }
@@ -0,0 +1,84 @@
+package benchmark
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHandlerCompletion(t *testing.T) {
+	type message struct {
+		producer uint32
+		sequence uint64
+		flags    uint8
+	}
+	tests := []struct {
+		name      string
+		count     int
+		producers int
+		messages  []message
+		// completeAt is the index of the message that completes the
+		// handler, -1 if none does.
+		completeAt int
+	}{
+		{
+			name:       "fin",
+			messages:   []message{{1, 1, 0}, {1, 2, 0}, {1, 2, FlagFin}},
+			completeAt: 2,
+		},
+		{
+			name:       "fin without data",
+			messages:   []message{{1, 0, FlagFin}},
+			completeAt: 0,
+		},
+		{
+			name:       "waits for the fin of every producer",
+			messages:   []message{{1, 1, 0}, {2, 1, 0}, {1, 1, FlagFin}, {2, 2, 0}, {2, 2, FlagFin}},
+			completeAt: 4,
+		},
+		{
+			name:       "producer count",
+			producers:  2,
+			messages:   []message{{1, 1, 0}, {1, 1, FlagFin}, {2, 1, 0}, {2, 1, FlagFin}},
+			completeAt: 3,
+		},
+		{
+			name:       "producer count not reached",
+			producers:  3,
+			messages:   []message{{1, 1, 0}, {1, 1, FlagFin}, {2, 1, 0}, {2, 1, FlagFin}},
+			completeAt: -1,
+		},
+		{
+			name:       "count",
+			count:      2,
+			messages:   []message{{1, 1, 0}, {1, 1, 0}, {1, 2, 0}},
+			completeAt: 2,
+		},
+		{
+			name:       "count of every producer",
+			count:      2,
+			messages:   []message{{1, 1, 0}, {2, 1, 0}, {1, 2, 0}, {2, 2, 0}},
+			completeAt: 3,
+		},
+		{
+			name:       "count or fin",
+			count:      2,
+			messages:   []message{{1, 1, 0}, {2, 1, 0}, {2, 1, FlagFin}, {1, 2, 0}},
+			completeAt: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("REPORT_INTERVAL_MS", "0")
+			t.Setenv("PRODUCER_COUNT", strconv.Itoa(test.producers))
+			handler := NewAllInOneMessageHandler(test.count, 0)
+			for i, m := range test.messages {
+				message := make([]byte, HeaderSize)
+				Header{ProducerID: m.producer, Sequence: m.sequence, Flags: m.flags}.Encode(message)
+				last := handler.ReceiveMessage(message)
+				if last != (i == test.completeAt) || handler.HasCompleted() != (i >= test.completeAt && test.completeAt >= 0) {
+					t.Fatalf("message %d: last %t, completed %t, want completion at %d", i, last, handler.HasCompleted(), test.completeAt)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package benchmark
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Version is the git version of the build, set with
+// -ldflags "-X github.com/green-lantern-id/mq-benchmarking/benchmark.Version=..."
+var Version = "unknown"
+
+// OptionsReporter is implemented by drivers that can describe the broker
+// options they run with.
+type OptionsReporter interface {
+	Options() map[string]string
+}
+
+// StatsReporter is implemented by drivers that count what the harness cannot
+// see, such as sends dropped at a high-water mark. Stats is read once the test
+// is over.
+type StatsReporter interface {
+	Stats() *DriverStats
+}
+
+// PublishReporter is implemented by drivers that wait for the broker to
+// acknowledge publishes.
+type PublishReporter interface {
+	// PublishLatencies is a copy of the acknowledgement latencies so far.
+	PublishLatencies() *LatencyHistogram
+	PublishErrors() int64
+}
+
+// DriverStats are the driver's own results. Notes state what the counters
+// cannot tell.
+type DriverStats struct {
+	Counters  map[string]int64          `json:"counters,omitempty"`
+	Latencies map[string]LatencySummary `json:"latencies,omitempty"`
+	Notes     []string                  `json:"notes,omitempty"`
+}
+
+// Report is the JSON result document of one run. Producer and consumer are
+// only set for the side that ran in this process.
+type Report struct {
+	Broker    string            `json:"broker"`
+	Mode      string            `json:"mode"`
+	Version   string            `json:"version"`
+	Host      HostInfo          `json:"host"`
+	Options   map[string]string `json:"options,omitempty"`
+	Generator *GeneratorConfig  `json:"generator,omitempty"`
+	Started   time.Time         `json:"started"`
+	Stopped   time.Time         `json:"stopped"`
+	Producer  *ProducerResult   `json:"producer,omitempty"`
+	Consumer  *ConsumerResult   `json:"consumer,omitempty"`
+	Driver    *DriverStats      `json:"driver,omitempty"`
+}
+
+type HostInfo struct {
+	Hostname  string `json:"hostname"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	CPUs      int    `json:"cpus"`
+	GoVersion string `json:"go_version"`
+}
+
+// GeneratorConfig holds the rate and size generator parameters of a producer.
+type GeneratorConfig struct {
+	Rate              string  `json:"rate"`
+	DelayUs           int     `json:"delay_us,omitempty"`
+	PoissonAvgDelayUs float64 `json:"poisson_avg_delay_us,omitempty"`
+	MessageSize       int     `json:"message_size"`
+	DurationMs        int     `json:"duration_ms"`
+	WarmupMs          int     `json:"warmup_ms,omitempty"`
+	FinEnabled        bool    `json:"fin_enabled"`
+}
+
+type ProducerResult struct {
+	ProducerID uint32    `json:"producer_id"`
+	Started    time.Time `json:"started"`
+	Stopped    time.Time `json:"stopped"`
+	Messages   int       `json:"messages"`
+	Bytes      int64     `json:"bytes"`
+	// Throughput is in messages per second.
+	Throughput float64  `json:"throughput"`
+	Windows    []Window `json:"windows,omitempty"`
+	// PublishLatency is the time to the broker's acknowledgement, in
+	// milliseconds, for drivers that wait for one. Publishes still waiting
+	// when the producer stops are left out.
+	PublishLatency          *LatencySummary   `json:"publish_latency,omitempty"`
+	PublishLatencyHistogram *LatencyHistogram `json:"publish_latency_histogram,omitempty"`
+	PublishErrors           int64             `json:"publish_errors,omitempty"`
+	// Clock is the last estimate of the consumer clock, when synced.
+	Clock *ClockEstimate `json:"clock,omitempty"`
+}
+
+// TraceResult tells how complete the message trace is. Records dropped from
+// a full buffer are missing from the file.
+type TraceResult struct {
+	File    string `json:"file"`
+	Records int64  `json:"records"`
+	Dropped int64  `json:"dropped"`
+}
+
+type ConsumerResult struct {
+	Started    time.Time                `json:"started"`
+	Stopped    time.Time                `json:"stopped"`
+	Messages   int                      `json:"messages"`
+	Bytes      int64                    `json:"bytes"`
+	Invalid    int                      `json:"invalid"`
+	Throughput float64                  `json:"throughput"`
+	Delivery   DeliveryStats            `json:"delivery"`
+	Producers  map[uint32]DeliveryStats `json:"producers"`
+	// Latencies are in milliseconds. The histograms are HdrHistogram V2
+	// compressed, base64 encoded, so runs can be merged afterwards.
+	Latency                  LatencySummary    `json:"latency"`
+	ResponseLatency          LatencySummary    `json:"response_latency"`
+	LatencyHistogram         *LatencyHistogram `json:"latency_histogram"`
+	ResponseLatencyHistogram *LatencyHistogram `json:"response_latency_histogram"`
+	// Latencies below zero are recorded as zero, those above the histogram
+	// maximum as the maximum. These count how many were clamped.
+	NegativeLatencies         int64        `json:"negative_latencies"`
+	OverflowLatencies         int64        `json:"overflow_latencies"`
+	ResponseNegativeLatencies int64        `json:"response_negative_latencies"`
+	ResponseOverflowLatencies int64        `json:"response_overflow_latencies"`
+	Trace                     *TraceResult `json:"trace,omitempty"`
+	Windows                   []Window     `json:"windows,omitempty"`
+	// Clocks are the last clock estimates per producer. Latencies of their
+	// messages are corrected by them, ClockUncorrected counts the messages
+	// that arrived before the first estimate of their producer. ClockIgnored
+	// counts estimates older than the one in use, ClockMissing lists the
+	// producers no estimate arrived from although the consumer syncs clocks.
+	Clocks           map[uint32]ClockEstimate `json:"clocks,omitempty"`
+	ClockUncorrected int64                    `json:"clock_uncorrected,omitempty"`
+	ClockIgnored     int64                    `json:"clock_ignored,omitempty"`
+	ClockMissing     []uint32                 `json:"clock_missing,omitempty"`
+}
+
+func NewReport(broker string, mode string) *Report {
+	hostname, _ := os.Hostname()
+	return &Report{
+		Broker:  broker,
+		Mode:    mode,
+		Version: Version,
+		Host: HostInfo{
+			Hostname:  hostname,
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+			CPUs:      runtime.NumCPU(),
+			GoVersion: runtime.Version(),
+		},
+		Started: time.Now(),
+	}
+}
+
+// Write stores the report as indented JSON. An empty path skips it.
+func (report *Report) Write(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode report: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write report: %s", err)
+	}
+	log.Printf("Report written to %s", path)
+	return nil
+}
+
+// WriteDistributions writes the latency percentile distributions of the
+// consumer next to the report at path: the path without ".json" followed by
+// "_latency.csv" and "_response_latency.csv". An empty path skips them.
+func (report *Report) WriteDistributions(path string) error {
+	if path == "" || report.Consumer == nil {
+		return nil
+	}
+	base := strings.TrimSuffix(path, ".json")
+	if err := writeDistribution(base+"_latency.csv", report.Consumer.LatencyHistogram); err != nil {
+		return err
+	}
+	return writeDistribution(base+"_response_latency.csv", report.Consumer.ResponseLatencyHistogram)
+}
+
+func writeDistribution(path string, latencies *LatencyHistogram) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "percentile,latency_ms,count\n")
+	for _, row := range latencies.Distribution() {
+		fmt.Fprintf(writer, "%f,%f,%d\n", row[0], row[1], int64(row[2]))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Latency distribution written to %s", path)
+	return nil
+}
+
+// ReadReport loads a report written by Write.
+func ReadReport(path string) (*Report, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func throughput(messages int, started, stopped time.Time) float64 {
+	elapsed := stopped.Sub(started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(messages) / elapsed
+}
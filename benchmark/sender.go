@@ -1,12 +1,14 @@
 package benchmark
 
 import (
-	"encoding/binary"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/green-lantern-id/mq-benchmarking/benchmark/distribution"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
 )
 
 type MessageSender interface {
@@ -15,58 +17,150 @@ type MessageSender interface {
 
 type SendEndpoint struct {
 	MessageSender MessageSender
+	ProducerID    uint32
+	sequence      uint64
 }
 
-func (endpoint SendEndpoint) sendMsg(msgSize int, fin int64) {
-	message := make([]byte, msgSize)
-	binary.PutVarint(message, time.Now().UnixNano())
-	binary.PutVarint(message[9:], fin)
+func NewSendEndpoint(sender MessageSender, producerID uint32) *SendEndpoint {
+	return &SendEndpoint{
+		MessageSender: sender,
+		ProducerID:    producerID,
+	}
+}
+
+// scheduledMessage is one entry of the open-loop send schedule.
+type scheduledMessage struct {
+	size     int
+	intended int64
+}
+
+// Build a message of msgSize bytes (at least HeaderSize) stamped with the next
+// sequence number and the current time. Without an intended send time the
+// message is taken to be on schedule.
+func (endpoint *SendEndpoint) newMessage(msgSize int, flags uint8, intended int64) []byte {
+	message := make([]byte, messageSize(msgSize))
+	header := Header{
+		Flags:      flags,
+		ProducerID: endpoint.ProducerID,
+	}
+	switch {
+	case flags&FlagFin != 0:
+		header.Sequence = atomic.LoadUint64(&endpoint.sequence)
+	case flags&(FlagWarmup|FlagControl) != 0:
+		// Warmup and control messages stay out of the sequence, or consumers
+		// would count the ones they missed as lost.
+	default:
+		header.Sequence = atomic.AddUint64(&endpoint.sequence, 1)
+	}
+	header.SendTime = time.Now().UnixNano()
+	header.IntendedTime = intended
+	if intended == 0 {
+		header.IntendedTime = header.SendTime
+	}
+	header.Encode(message)
+	return message
+}
+
+// messageSize is the size actually sent for a requested msgSize.
+func messageSize(msgSize int) int {
+	if msgSize < HeaderSize {
+		return HeaderSize
+	}
+	return msgSize
+}
+
+// send passes message to the driver and keeps the live metrics up to date.
+func (endpoint *SendEndpoint) send(message []byte) {
+	metrics.InFlight.Inc()
+	endpoint.MessageSender.Send(message)
+	metrics.InFlight.Dec()
+	metrics.MessagesSent.Inc()
+	metrics.BytesSent.Add(float64(len(message)))
+}
+
+// sendControl sends a FlagControl message with payload. Control messages are
+// not load, they are counted apart from the messages sent.
+func (endpoint *SendEndpoint) sendControl(payload []byte) {
+	message := endpoint.newMessage(HeaderSize+len(payload), FlagControl, 0)
+	copy(message[HeaderSize:], payload)
+	metrics.InFlight.Inc()
 	endpoint.MessageSender.Send(message)
+	metrics.InFlight.Dec()
+	metrics.ControlMessagesSent.Inc()
 }
 
-func (endpoint SendEndpoint) StartDuration(numMsg int, duration int, delayUs int, msgSize int, poissonRate float64, isPoisson bool, finEnabled bool) {
+func (endpoint *SendEndpoint) sendMsg(msgSize int, flags uint8) {
+	endpoint.send(endpoint.newMessage(msgSize, flags, 0))
+}
+
+// StartDuration sends messages for duration milliseconds or until numMsg
+// messages are sent, whichever comes first. Either may be 0 but not both.
+func (endpoint *SendEndpoint) StartDuration(numMsg int, duration int, delayUs int, msgSize int, poissonRate float64, isPoisson bool, finEnabled bool) *ProducerResult {
 	started := time.Now().UnixNano()
 	poisson := distribution.GeneratePoisson(poissonRate)
-	msgSizeChan := make(chan int)
+	schedule := make(chan scheduledMessage)
 	done := make(chan bool)
-	delay := delayUs
-	doneSign := false
+	recorder := newWindowRecorder(false)
 
-	//Start sampling
+	// Start sampling. The schedule is open loop: every message is due a delay
+	// after the previous one was due, not after it was sent. A producer that
+	// stalls catches up instead of quietly lowering the rate, and the intended
+	// time lets the consumer see the queueing delay (coordinated omission).
 	go func() {
-		for !doneSign {
+		intended := started
+		for {
+			delay := delayUs
 			if isPoisson {
 				delay = poisson.Sample()
 			}
-			<-time.After(time.Microsecond * time.Duration(delay))
-			msgSizeChan <- msgSize
+			intended += int64(time.Microsecond * time.Duration(delay))
+			time.Sleep(time.Duration(intended - time.Now().UnixNano()))
+			select {
+			case schedule <- scheduledMessage{size: msgSize, intended: intended}:
+			case <-done:
+				return
+			}
 		}
 	}()
 
-	// Start ending clock
-	go func() {
-		<-time.After(time.Millisecond * time.Duration(duration))
-		done <- true
-	}()
+	// Start ending clock, without a duration only numMsg ends the test.
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(time.Millisecond * time.Duration(duration))
+	}
 
 	// Sending message
 	msgCount := 0
-	for !doneSign {
+	var sending sync.WaitGroup
+	for running := true; running; {
 		select {
-		case msgSize := <-msgSizeChan:
-			go endpoint.sendMsg(msgSize, 0)
+		case message := <-schedule:
+			// The message is built before the goroutine starts, so sequence
+			// numbers follow the schedule and no send can reorder them.
+			sending.Add(1)
+			go func(message []byte) {
+				defer sending.Done()
+				endpoint.send(message)
+			}(endpoint.newMessage(message.size, 0, message.intended))
 			msgCount++
-		case d := <-done:
-			doneSign = d
+			recorder.record(time.Now().UnixNano(), messageSize(message.size), 0)
+			if numMsg > 0 && msgCount == numMsg {
+				close(done)
+				running = false
+			}
+		case <-timeout:
+			close(done)
+			running = false
 		}
 	}
 
-	// Send fin
+	// Send fin, after the data still in flight or the FIN could overtake it.
 	ended := time.Now().UnixNano()
+	sending.Wait()
 	if finEnabled {
 		log.Printf("Sending FIN messages")
 		for i := 0; i < 1000; i++ {
-			endpoint.sendMsg(1024, 0xff)
+			endpoint.sendMsg(1024, FlagFin)
 			<-time.After(time.Millisecond)
 		}
 	}
@@ -74,9 +168,33 @@ func (endpoint SendEndpoint) StartDuration(numMsg int, duration int, delayUs int
 	ms := float32(ended-started) / 1000000
 	log.Printf("Time: %f ms", ms)
 	log.Printf("Message sent: %d", msgCount)
+
+	return &ProducerResult{
+		ProducerID: endpoint.ProducerID,
+		Started:    time.Unix(0, started),
+		Stopped:    time.Unix(0, ended),
+		Messages:   msgCount,
+		Bytes:      int64(msgCount) * int64(messageSize(msgSize)),
+		Throughput: throughput(msgCount, time.Unix(0, started), time.Unix(0, ended)),
+		Windows:    recorder.finish(ended),
+	}
+}
+
+// Warmup sends messages flagged FlagWarmup for duration milliseconds, one
+// every delayUs. Consumers leave them out of the results.
+func (endpoint *SendEndpoint) Warmup(duration int, delayUs int, msgSize int) {
+	if duration <= 0 {
+		return
+	}
+	log.Printf("Warming up for %d ms", duration)
+	ended := time.Now().Add(time.Millisecond * time.Duration(duration))
+	for time.Now().Before(ended) {
+		endpoint.sendMsg(msgSize, FlagWarmup)
+		<-time.After(time.Microsecond * time.Duration(delayUs))
+	}
 }
 
-func (endpoint SendEndpoint) StartPoisson(numMsg int, duration int, delayUs int, msgSize int, poissonRate float64, isPoisson bool) {
+func (endpoint *SendEndpoint) StartPoisson(numMsg int, duration int, delayUs int, msgSize int, poissonRate float64, isPoisson bool) {
 
 	// Sample wait time.
 	poisson := distribution.GeneratePoisson(poissonRate)
@@ -93,7 +211,7 @@ func (endpoint SendEndpoint) StartPoisson(numMsg int, duration int, delayUs int,
 			<-time.After(time.Microsecond * time.Duration(delay))
 		}
 		// Sent FIN message
-		endpoint.sendMsg(msgSize, 0xff)
+		endpoint.sendMsg(msgSize, FlagFin)
 		fmt.Printf("\nSent FIN\n")
 
 	} else { // assume that duration is not zero
@@ -131,7 +249,7 @@ func (endpoint SendEndpoint) StartPoisson(numMsg int, duration int, delayUs int,
 		ended = time.Now().UnixNano()
 
 		for j := 0; j < 1000; j++ {
-			endpoint.sendMsg(1024, 0xff)
+			endpoint.sendMsg(1024, FlagFin)
 			<-time.After(time.Millisecond)
 		}
 		fmt.Printf("\nSend FIN (every 1ms for 1 sec)\n")
@@ -143,7 +261,7 @@ func (endpoint SendEndpoint) StartPoisson(numMsg int, duration int, delayUs int,
 	log.Printf("Time: %f ms", ms)
 }
 
-func (endpoint SendEndpoint) SendMsg(msgSize <-chan int, doneSignal <-chan bool) {
+func (endpoint *SendEndpoint) SendMsg(msgSize <-chan int, doneSignal <-chan bool) {
 	done := false
 	log.Printf("Start sender")
 	i := 1
@@ -151,9 +269,7 @@ func (endpoint SendEndpoint) SendMsg(msgSize <-chan int, doneSignal <-chan bool)
 	for done != true {
 		select {
 		case mSize := <-msgSize:
-			message := make([]byte, mSize)
-			binary.PutVarint(message, time.Now().UnixNano())
-			endpoint.MessageSender.Send(message)
+			endpoint.sendMsg(mSize, 0)
 			fmt.Printf("\rMessage Sent: %d", i)
 			i++
 		case signal := <-doneSignal:
@@ -164,7 +280,7 @@ func (endpoint SendEndpoint) SendMsg(msgSize <-chan int, doneSignal <-chan bool)
 	ended := time.Now().UnixNano()
 
 	for j := 0; j < 1000; j++ {
-		endpoint.sendMsg(1024, 0xff)
+		endpoint.sendMsg(1024, FlagFin)
 		<-time.After(time.Millisecond)
 	}
 	fmt.Printf("\nSend FIN (every 1ms for 1 sec)\n")
@@ -174,13 +290,11 @@ func (endpoint SendEndpoint) SendMsg(msgSize <-chan int, doneSignal <-chan bool)
 }
 
 // Merge TestLatency and TestThroughput in one single test
-func (endpoint SendEndpoint) TestAll(messageSize int, numberToSend int) {
-	message := make([]byte, messageSize)
+func (endpoint *SendEndpoint) TestAll(messageSize int, numberToSend int) {
 	start := time.Now().UnixNano()
 
 	for i := 0; i < numberToSend; i++ {
-		binary.PutVarint(message, time.Now().UnixNano())
-		endpoint.MessageSender.Send(message)
+		endpoint.sendMsg(messageSize, 0)
 	}
 
 	stop := time.Now().UnixNano()
@@ -188,11 +302,10 @@ func (endpoint SendEndpoint) TestAll(messageSize int, numberToSend int) {
 	log.Printf("Send %d messages in %f ms\n", numberToSend, ms)
 }
 
-func (endpoint SendEndpoint) TestThroughput(messageSize int, numberToSend int) {
-	message := make([]byte, messageSize)
+func (endpoint *SendEndpoint) TestThroughput(messageSize int, numberToSend int) {
 	start := time.Now().UnixNano()
 	for i := 0; i < numberToSend; i++ {
-		endpoint.MessageSender.Send(message)
+		endpoint.sendMsg(messageSize, 0)
 	}
 
 	stop := time.Now().UnixNano()
@@ -201,12 +314,10 @@ func (endpoint SendEndpoint) TestThroughput(messageSize int, numberToSend int) {
 	log.Printf("Sent %f per second\n", 1000*float32(numberToSend)/ms)
 }
 
-func (endpoint SendEndpoint) TestLatency(messageSize int, numberToSend int) {
+func (endpoint *SendEndpoint) TestLatency(messageSize int, numberToSend int) {
 	start := time.Now().UnixNano()
-	b := make([]byte, 9)
 	for i := 0; i < numberToSend; i++ {
-		binary.PutVarint(b, time.Now().UnixNano())
-		endpoint.MessageSender.Send(b)
+		endpoint.sendMsg(HeaderSize, 0)
 		log.Printf("Message Sent")
 	}
 
@@ -0,0 +1,65 @@
+package benchmark
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSender keeps the headers of everything sent through it. Sends are
+// slowed down so several of them are in flight at once.
+type recordingSender struct {
+	mu      sync.Mutex
+	headers []Header
+}
+
+func (s *recordingSender) Send(message []byte) {
+	time.Sleep(time.Millisecond)
+	header, err := DecodeHeader(message)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	s.headers = append(s.headers, header)
+	s.mu.Unlock()
+}
+
+func TestStartDurationSequence(t *testing.T) {
+	sender := &recordingSender{}
+	endpoint := NewSendEndpoint(sender, 3)
+	result := endpoint.StartDuration(0, 50, 200, 64, 0, false, false)
+
+	// Every message is sent by the time StartDuration returns, where a FIN
+	// would follow.
+	sender.mu.Lock()
+	headers := append([]Header(nil), sender.headers...)
+	sender.mu.Unlock()
+	if result.Messages == 0 {
+		t.Fatal("nothing sent")
+	}
+	if len(headers) != result.Messages {
+		t.Fatalf("%d messages arrived at the driver, %d were sent", len(headers), result.Messages)
+	}
+
+	// Sequence numbers are 1..n without gaps and follow the schedule.
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Sequence < headers[j].Sequence })
+	for i, header := range headers {
+		if header.Sequence != uint64(i+1) {
+			t.Fatalf("message %d has sequence %d", i+1, header.Sequence)
+		}
+		if header.ProducerID != 3 {
+			t.Errorf("message %d has producer %d, want 3", i+1, header.ProducerID)
+		}
+		if i > 0 && header.IntendedTime <= headers[i-1].IntendedTime {
+			t.Errorf("sequence %d is due at %d, not after sequence %d due at %d",
+				header.Sequence, header.IntendedTime, headers[i-1].Sequence, headers[i-1].IntendedTime)
+		}
+	}
+
+	endpoint.sendMsg(HeaderSize, FlagFin)
+	fin := sender.headers[len(sender.headers)-1]
+	if !fin.Has(FlagFin) || fin.Sequence != uint64(result.Messages) {
+		t.Errorf("FIN %s, want the last sequence %d", fin, result.Messages)
+	}
+}
@@ -0,0 +1,130 @@
+package benchmark
+
+import (
+	"sort"
+)
+
+// DeliveryStats summarizes the sequence numbers seen from one or more
+// producers.
+type DeliveryStats struct {
+	// Expected is the highest sequence number sent, as far as the consumer
+	// knows from data and FIN messages.
+	Expected   uint64 `json:"expected"`
+	Received   uint64 `json:"received"`
+	Lost       uint64 `json:"lost"`
+	Duplicates uint64 `json:"duplicates"`
+	// Reordered counts messages that arrived after a higher sequence number.
+	Reordered uint64 `json:"reordered"`
+}
+
+func (s DeliveryStats) LossRate() float64 {
+	return rate(s.Lost, s.Expected)
+}
+
+func (s DeliveryStats) DuplicateRate() float64 {
+	return rate(s.Duplicates, s.Received+s.Duplicates)
+}
+
+func (s DeliveryStats) ReorderRate() float64 {
+	return rate(s.Reordered, s.Received)
+}
+
+func (s DeliveryStats) add(other DeliveryStats) DeliveryStats {
+	return DeliveryStats{
+		Expected:   s.Expected + other.Expected,
+		Received:   s.Received + other.Received,
+		Lost:       s.Lost + other.Lost,
+		Duplicates: s.Duplicates + other.Duplicates,
+		Reordered:  s.Reordered + other.Reordered,
+	}
+}
+
+func rate(count, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+// sequenceGap is a closed range of sequence numbers not received yet.
+type sequenceGap struct {
+	from, to uint64
+}
+
+// sequenceTracker follows the sequence numbers of a single producer. Gaps are
+// kept as ranges so memory grows with the number of loss events rather than
+// with the number of messages.
+type sequenceTracker struct {
+	highest     uint64
+	finSequence uint64
+	finSeen     bool
+	gaps        []sequenceGap
+	received    uint64
+	duplicates  uint64
+	reordered   uint64
+}
+
+func (t *sequenceTracker) fin(sequence uint64) {
+	t.finSeen = true
+	if sequence > t.finSequence {
+		t.finSequence = sequence
+	}
+}
+
+// finished tells whether the producer has sent its FIN.
+func (t *sequenceTracker) finished() bool {
+	return t.finSeen
+}
+
+func (t *sequenceTracker) record(sequence uint64) {
+	if sequence > t.highest {
+		if sequence > t.highest+1 {
+			t.gaps = append(t.gaps, sequenceGap{t.highest + 1, sequence - 1})
+		}
+		t.highest = sequence
+		t.received++
+		return
+	}
+
+	// Gaps are sorted, find the first one ending at or after sequence.
+	i := sort.Search(len(t.gaps), func(i int) bool { return t.gaps[i].to >= sequence })
+	if i == len(t.gaps) || t.gaps[i].from > sequence {
+		t.duplicates++
+		return
+	}
+
+	t.received++
+	t.reordered++
+	gap := t.gaps[i]
+	switch {
+	case gap.from == gap.to:
+		t.gaps = append(t.gaps[:i], t.gaps[i+1:]...)
+	case sequence == gap.from:
+		t.gaps[i].from++
+	case sequence == gap.to:
+		t.gaps[i].to--
+	default:
+		t.gaps = append(t.gaps, sequenceGap{})
+		copy(t.gaps[i+2:], t.gaps[i+1:])
+		t.gaps[i] = sequenceGap{gap.from, sequence - 1}
+		t.gaps[i+1] = sequenceGap{sequence + 1, gap.to}
+	}
+}
+
+func (t *sequenceTracker) stats() DeliveryStats {
+	expected := t.highest
+	if t.finSequence > expected {
+		expected = t.finSequence
+	}
+	lost := expected - t.highest
+	for _, gap := range t.gaps {
+		lost += gap.to - gap.from + 1
+	}
+	return DeliveryStats{
+		Expected:   expected,
+		Received:   t.received,
+		Lost:       lost,
+		Duplicates: t.duplicates,
+		Reordered:  t.reordered,
+	}
+}
@@ -0,0 +1,129 @@
+package benchmark
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	tests := []struct {
+		name      string
+		sequences []uint64
+		fin       uint64
+		want      DeliveryStats
+		gaps      []sequenceGap
+	}{
+		{
+			name:      "in order",
+			sequences: []uint64{1, 2, 3, 4},
+			want:      DeliveryStats{Expected: 4, Received: 4},
+		},
+		{
+			name:      "gap",
+			sequences: []uint64{1, 2, 5, 6},
+			want:      DeliveryStats{Expected: 6, Received: 4, Lost: 2},
+			gaps:      []sequenceGap{{3, 4}},
+		},
+		{
+			name:      "first messages missing",
+			sequences: []uint64{3, 4},
+			want:      DeliveryStats{Expected: 4, Received: 2, Lost: 2},
+			gaps:      []sequenceGap{{1, 2}},
+		},
+		{
+			name:      "late fill splits a gap",
+			sequences: []uint64{1, 10, 5},
+			want:      DeliveryStats{Expected: 10, Received: 3, Lost: 7, Reordered: 1},
+			gaps:      []sequenceGap{{2, 4}, {6, 9}},
+		},
+		{
+			name:      "late fills shrink a gap from both ends",
+			sequences: []uint64{1, 6, 2, 5},
+			want:      DeliveryStats{Expected: 6, Received: 4, Lost: 2, Reordered: 2},
+			gaps:      []sequenceGap{{3, 4}},
+		},
+		{
+			name:      "late fills close a gap",
+			sequences: []uint64{1, 4, 3, 2},
+			want:      DeliveryStats{Expected: 4, Received: 4, Reordered: 2},
+		},
+		{
+			name:      "late fill in the second gap",
+			sequences: []uint64{1, 3, 6, 4},
+			want:      DeliveryStats{Expected: 6, Received: 4, Lost: 2, Reordered: 1},
+			gaps:      []sequenceGap{{2, 2}, {5, 5}},
+		},
+		{
+			name:      "duplicate",
+			sequences: []uint64{1, 2, 2, 3, 1},
+			want:      DeliveryStats{Expected: 3, Received: 3, Duplicates: 2},
+		},
+		{
+			name:      "duplicate of a late fill",
+			sequences: []uint64{1, 3, 2, 2},
+			want:      DeliveryStats{Expected: 3, Received: 3, Duplicates: 1, Reordered: 1},
+		},
+		{
+			name:      "fin with missing tail",
+			sequences: []uint64{1, 2, 3},
+			fin:       6,
+			want:      DeliveryStats{Expected: 6, Received: 3, Lost: 3},
+		},
+		{
+			name:      "fin and gap",
+			sequences: []uint64{1, 3},
+			fin:       5,
+			want:      DeliveryStats{Expected: 5, Received: 2, Lost: 3},
+			gaps:      []sequenceGap{{2, 2}},
+		},
+		{
+			name:      "fin behind the data",
+			sequences: []uint64{1, 2, 3},
+			fin:       2,
+			want:      DeliveryStats{Expected: 3, Received: 3},
+		},
+		{
+			name: "nothing but a fin",
+			fin:  3,
+			want: DeliveryStats{Expected: 3, Lost: 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := &sequenceTracker{}
+			for _, sequence := range test.sequences {
+				tracker.record(sequence)
+			}
+			if test.fin != 0 {
+				tracker.fin(test.fin)
+			}
+			if got := tracker.stats(); got != test.want {
+				t.Errorf("stats %+v, want %+v", got, test.want)
+			}
+			if len(tracker.gaps) != 0 || len(test.gaps) != 0 {
+				if !reflect.DeepEqual(tracker.gaps, test.gaps) {
+					t.Errorf("gaps %v, want %v", tracker.gaps, test.gaps)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliveryStatsRates(t *testing.T) {
+	stats := DeliveryStats{Expected: 10, Received: 8, Lost: 2, Duplicates: 2, Reordered: 4}
+	if got := stats.LossRate(); got != 0.2 {
+		t.Errorf("loss rate %f, want 0.2", got)
+	}
+	if got := stats.DuplicateRate(); got != 0.2 {
+		t.Errorf("duplicate rate %f, want 0.2", got)
+	}
+	if got := stats.ReorderRate(); got != 0.5 {
+		t.Errorf("reorder rate %f, want 0.5", got)
+	}
+	if got := (DeliveryStats{}).LossRate(); got != 0 {
+		t.Errorf("loss rate of nothing %f, want 0", got)
+	}
+	if got := stats.add(stats); got != (DeliveryStats{Expected: 20, Received: 16, Lost: 4, Duplicates: 4, Reordered: 8}) {
+		t.Errorf("sum %+v", got)
+	}
+}
@@ -1,11 +1,26 @@
 package benchmark
 
 import (
+	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// Consumes tells whether a tester in client mode receives messages. Mode
+// "all" runs producer and consumer in one process against the same broker.
+func Consumes(mode string) bool {
+	return mode == "consumer" || mode == "all"
+}
+
+// Produces tells whether a tester in client mode sends messages.
+func Produces(mode string) bool {
+	return mode == "producer" || mode == "all"
+}
+
 type Tester struct {
 	Name         string
 	MessageSize  int
@@ -14,23 +29,63 @@ type Tester struct {
 	MessageSender
 	MessageReceiver
 	Mode string
+	// ReportFile is where the JSON report goes, empty skips it.
+	ReportFile string
+	// ProducerID is written into every message, random when 0.
+	ProducerID uint32
 }
 
-func (tester Tester) Test() {
+func (tester Tester) Test() error {
 	log.Printf("Begin %s test", tester.Name)
-	if tester.Mode == "consumer" {
+	if Consumes(tester.Mode) {
 		tester.Setup()
 	}
+	if tester.Mode == "all" {
+		// Consumers such as Kafka group members subscribe in the background,
+		// messages sent before they are ready would be lost.
+		setupDelay, _ := strconv.Atoi(getEnv("SETUP_DELAY_MS", "1000"))
+		time.Sleep(time.Duration(setupDelay) * time.Millisecond)
+	}
 	defer tester.Teardown()
 	testDuration, _ := strconv.Atoi(getEnv("TEST_DURATION", "0"))
 	msgSize, _ := strconv.Atoi(getEnv("MSG_UNIFORM_SIZE", "1024"))
 	fin, _ := strconv.ParseBool(getEnv("FIN_ENABLED", "false"))
+	warmup, _ := strconv.Atoi(getEnv("WARMUP_MS", "0"))
+
+	report := NewReport(tester.Name, tester.Mode)
+	if driver, ok := tester.MessageReceiver.(OptionsReporter); ok {
+		report.Options = driver.Options()
+	}
+
+	log.Printf("Running %s mode", tester.Mode)
+	if Produces(tester.Mode) {
+		id := tester.ProducerID
+		if id == 0 {
+			id = producerID()
+		}
+		sender := NewSendEndpoint(tester, id)
+		log.Printf("Producer ID: %d", sender.ProducerID)
 
-	if tester.Mode == "producer" {
-		log.Printf("Running producer mode")
-		sender := &SendEndpoint{MessageSender: tester}
+		// In mode "all" both sides read the same clock, there is nothing to sync.
+		var clock *clockSync
+		if server := getEnv("CLOCK_SYNC_SERVER", ""); server != "" && tester.Mode == "producer" {
+			samples, _ := strconv.Atoi(getEnv("CLOCK_SYNC_SAMPLES", "8"))
+			interval, _ := strconv.Atoi(getEnv("CLOCK_SYNC_INTERVAL_MS", "1000"))
+			var err error
+			clock, err = startClockSync(sender, server, samples, time.Duration(interval)*time.Millisecond)
+			if err != nil {
+				return err
+			}
+		}
 
 		msgRateGenerator := getEnv("MSG_RATE_GENERATOR", "uniform") // uniform|poisson
+		report.Generator = &GeneratorConfig{
+			Rate:        msgRateGenerator,
+			WarmupMs:    warmup,
+			MessageSize: msgSize,
+			DurationMs:  testDuration,
+			FinEnabled:  fin,
+		}
 
 		if msgRateGenerator == "uniform" {
 			uniformRate, _ := strconv.Atoi(getEnv("MSG_UNIFORM_DELAY_US", "1000"))
@@ -39,7 +94,9 @@ func (tester Tester) Test() {
 			log.Printf("Delay Time: %d micro-seconds", uniformRate)
 			log.Printf("Message Size: %d bytes", msgSize)
 			log.Printf("================================")
-			sender.StartDuration(tester.MessageCount, testDuration, uniformRate, msgSize, 0, false, fin)
+			report.Generator.DelayUs = uniformRate
+			sender.Warmup(warmup, uniformRate, msgSize)
+			report.Producer = sender.StartDuration(tester.MessageCount, testDuration, uniformRate, msgSize, 0, false, fin)
 		} else { // poisson
 			poissonAvgRate, _ := strconv.ParseFloat(getEnv("MSG_POISSON_AVG_DELAY", "500.0"), 64)
 			log.Printf("======= Test configuation ======")
@@ -47,17 +104,65 @@ func (tester Tester) Test() {
 			log.Printf("Average Rate: %f micro-seconds", poissonAvgRate)
 			log.Printf("Message Size: %d bytes", msgSize)
 			log.Printf("================================")
-			sender.StartDuration(tester.MessageCount, testDuration, 0, msgSize, poissonAvgRate, true, fin)
+			report.Generator.PoissonAvgDelayUs = poissonAvgRate
+			sender.Warmup(warmup, int(poissonAvgRate), msgSize)
+			report.Producer = sender.StartDuration(tester.MessageCount, testDuration, 0, msgSize, poissonAvgRate, true, fin)
+		}
+		if publisher, ok := tester.MessageSender.(PublishReporter); ok {
+			latencies := publisher.PublishLatencies()
+			summary := latencies.Summary()
+			report.Producer.PublishLatency = &summary
+			report.Producer.PublishLatencyHistogram = latencies
+			report.Producer.PublishErrors = publisher.PublishErrors()
 		}
-	} else {
-		log.Printf("Running consumer mode")
+		if clock != nil {
+			estimate := clock.stop()
+			log.Printf("Consumer clock: %s", estimate)
+			report.Producer.Clock = &estimate
+		}
+	}
+	// In mode "all" the consumer has been receiving since Setup, by now only
+	// the rest of the messages in flight are left.
+	if Consumes(tester.Mode) {
 		receiver := NewReceiveEndpoint(tester, tester.MessageCount)
 		receiver.WaitForCompletion()
+		if handler, ok := (*receiver.Handler).(*AllInOneMessageHandler); ok {
+			report.Consumer = handler.Result()
+		}
 	}
 
+	if driver, ok := tester.MessageReceiver.(StatsReporter); ok {
+		report.Driver = driver.Stats()
+	}
+
+	report.Stopped = time.Now()
+	if err := report.Write(tester.ReportFile); err != nil {
+		return err
+	}
+	if err := report.WriteDistributions(tester.ReportFile); err != nil {
+		return fmt.Errorf("cannot write latency distribution: %s", err)
+	}
 	log.Printf("End %s test", tester.Name)
+	return nil
+}
+
+// producerID tells apart the producers feeding one consumer. It is random
+// unless PRODUCER_ID is set.
+func producerID() uint32 {
+	if id, err := strconv.ParseUint(getEnv("PRODUCER_ID", ""), 10, 32); err == nil {
+		return uint32(id)
+	}
+	producerIDLock.Lock()
+	defer producerIDLock.Unlock()
+	return producerIDs.Uint32()
 }
 
+// Several producers may start at once in one process, so they share a source.
+var (
+	producerIDs    = rand.New(rand.NewSource(time.Now().UnixNano()))
+	producerIDLock sync.Mutex
+)
+
 func getEnv(key, defaultValue string) string {
 	value, exists := os.LookupEnv(key)
 	if !exists {
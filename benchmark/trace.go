@@ -0,0 +1,149 @@
+package benchmark
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// TraceRecord is one received message in the trace file. Times are unix
+// nanoseconds, intended and send time on the producer clock. ClockOffset moves
+// them onto the consumer clock, it is zero without clock sync.
+type TraceRecord struct {
+	ProducerID   uint32
+	Sequence     uint64
+	Flags        uint8
+	Size         int
+	IntendedTime int64
+	SendTime     int64
+	ReceiveTime  int64
+	ClockOffset  int64
+}
+
+const traceColumns = "producer_id,sequence,flags,size,intended_time_ns,send_time_ns,receive_time_ns,clock_offset_ns,latency_ns,response_latency_ns\n"
+
+// TraceWriter writes TraceRecords as CSV from a background goroutine. Write
+// never blocks: when the buffer is full the record is dropped and counted.
+type TraceWriter struct {
+	Path    string
+	records chan TraceRecord
+	file    *os.File
+	done    chan bool
+	written int64
+	dropped int64
+}
+
+// NewTraceWriter creates the trace file at path. The channel buffers up to
+// bufferSize records.
+func NewTraceWriter(path string, bufferSize int) (*TraceWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	trace := &TraceWriter{
+		Path:    path,
+		records: make(chan TraceRecord, bufferSize),
+		file:    file,
+		done:    make(chan bool),
+	}
+	go trace.run()
+	return trace, nil
+}
+
+// newTraceFromEnv returns the writer configured by TRACE_FILE, or nil when
+// tracing is off.
+func newTraceFromEnv() *TraceWriter {
+	path := getEnv("TRACE_FILE", "")
+	if path == "" {
+		return nil
+	}
+	bufferSize, _ := strconv.Atoi(getEnv("TRACE_BUFFER_SIZE", "65536"))
+	trace, err := NewTraceWriter(path, bufferSize)
+	if err != nil {
+		log.Printf("[ERROR] Cannot create trace file %s: %s", path, err)
+		return nil
+	}
+	log.Printf("Writing message trace to %s", path)
+	return trace
+}
+
+func (trace *TraceWriter) run() {
+	writer := bufio.NewWriterSize(trace.file, 1<<16)
+	writer.WriteString(traceColumns)
+
+	line := make([]byte, 0, 256)
+	for record := range trace.records {
+		line = line[:0]
+		line = strconv.AppendUint(line, uint64(record.ProducerID), 10)
+		line = append(line, ',')
+		line = strconv.AppendUint(line, record.Sequence, 10)
+		line = append(line, ',')
+		line = strconv.AppendUint(line, uint64(record.Flags), 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, int64(record.Size), 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, record.IntendedTime, 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, record.SendTime, 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, record.ReceiveTime, 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, record.ClockOffset, 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, record.ReceiveTime-record.SendTime-record.ClockOffset, 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, record.ReceiveTime-record.IntendedTime-record.ClockOffset, 10)
+		line = append(line, '\n')
+		if _, err := writer.Write(line); err != nil {
+			log.Printf("[ERROR] Cannot write trace file %s: %s", trace.Path, err)
+			atomic.AddInt64(&trace.dropped, 1)
+			break
+		}
+		atomic.AddInt64(&trace.written, 1)
+	}
+	// Keep draining after a write error so Close does not hang.
+	for range trace.records {
+		atomic.AddInt64(&trace.dropped, 1)
+	}
+
+	if err := writer.Flush(); err != nil {
+		log.Printf("[ERROR] Cannot write trace file %s: %s", trace.Path, err)
+	}
+	trace.file.Close()
+	close(trace.done)
+}
+
+func (trace *TraceWriter) Write(record TraceRecord) {
+	select {
+	case trace.records <- record:
+	default:
+		atomic.AddInt64(&trace.dropped, 1)
+	}
+}
+
+// Written is the number of records passed to the file.
+func (trace *TraceWriter) Written() int64 {
+	return atomic.LoadInt64(&trace.written)
+}
+
+// Dropped is the number of records lost because the buffer was full or the
+// file could not be written.
+func (trace *TraceWriter) Dropped() int64 {
+	return atomic.LoadInt64(&trace.dropped)
+}
+
+func (trace *TraceWriter) Result() *TraceResult {
+	return &TraceResult{
+		File:    trace.Path,
+		Records: trace.Written(),
+		Dropped: trace.Dropped(),
+	}
+}
+
+// Close writes out the buffered records and closes the file.
+func (trace *TraceWriter) Close() {
+	close(trace.records)
+	<-trace.done
+}
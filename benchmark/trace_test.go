@@ -0,0 +1,64 @@
+package benchmark
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTraceWriterDrops(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.csv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing drains the buffer until run starts, so the third record does not fit.
+	trace := &TraceWriter{
+		Path:    path,
+		records: make(chan TraceRecord, 2),
+		file:    file,
+		done:    make(chan bool),
+	}
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		trace.Write(TraceRecord{ProducerID: 1, Sequence: sequence, SendTime: 10, IntendedTime: 5, ReceiveTime: 30, ClockOffset: 5})
+	}
+	go trace.run()
+	trace.Close()
+
+	result := trace.Result()
+	if *result != (TraceResult{File: path, Records: 2, Dropped: 1}) {
+		t.Errorf("result %+v, want 2 records and 1 dropped", *result)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 3 || lines[0]+"\n" != traceColumns {
+		t.Fatalf("trace file %q, want the columns and 2 records", content)
+	}
+	if want := "1,1,0,0,5,10,30,5,15,20"; lines[1] != want {
+		t.Errorf("record %q, want %q", lines[1], want)
+	}
+}
+
+func TestTraceReport(t *testing.T) {
+	t.Setenv("TRACE_FILE", filepath.Join(t.TempDir(), "trace.csv"))
+	t.Setenv("REPORT_INTERVAL_MS", "0")
+	handler := NewAllInOneMessageHandler(0, 0)
+	message := make([]byte, HeaderSize)
+	Header{ProducerID: 1, Sequence: 1}.Encode(message)
+	handler.ReceiveMessage(message)
+	Header{ProducerID: 1, Sequence: 1, Flags: FlagFin}.Encode(message)
+	handler.ReceiveMessage(message)
+
+	result := handler.Result()
+	if result.Trace == nil {
+		t.Fatal("report without trace")
+	}
+	if result.Trace.Records != 2 || result.Trace.Dropped != 0 {
+		t.Errorf("trace %+v, want 2 records and none dropped", *result.Trace)
+	}
+}
@@ -0,0 +1,94 @@
+package benchmark
+
+import (
+	"strconv"
+	"time"
+)
+
+// Window is one interval of the time series in the report.
+type Window struct {
+	Start    time.Time `json:"start"`
+	Messages int       `json:"messages"`
+	Bytes    int64     `json:"bytes"`
+	// Throughput is in messages per second.
+	Throughput float64 `json:"throughput"`
+	// Latency is only known on the consumer side.
+	Latency *LatencySummary `json:"latency,omitempty"`
+}
+
+// windowRecorder cuts a run into fixed intervals starting at the first
+// recorded event. Intervals without any event are kept as empty windows, so
+// stalls show up in the series.
+type windowRecorder struct {
+	interval  time.Duration
+	origin    int64
+	index     int64
+	current   Window
+	latencies *LatencyHistogram
+	windows   []Window
+}
+
+// newWindowRecorder uses REPORT_INTERVAL_MS (default 1000). It returns nil when
+// the interval is 0, all methods accept a nil recorder.
+func newWindowRecorder(withLatency bool) *windowRecorder {
+	intervalMs, _ := strconv.Atoi(getEnv("REPORT_INTERVAL_MS", "1000"))
+	if intervalMs <= 0 {
+		return nil
+	}
+	recorder := &windowRecorder{interval: time.Duration(intervalMs) * time.Millisecond}
+	if withLatency {
+		recorder.latencies = NewLatencyHistogram()
+	}
+	return recorder
+}
+
+// record adds a message of size bytes seen at now (unix nanoseconds). latency
+// is ignored by recorders without latency.
+func (recorder *windowRecorder) record(now int64, size int, latency time.Duration) {
+	if recorder == nil {
+		return
+	}
+	if recorder.origin == 0 {
+		recorder.origin = now
+		recorder.current.Start = time.Unix(0, now)
+	}
+	for index := (now - recorder.origin) / int64(recorder.interval); recorder.index < index; {
+		recorder.flush(recorder.interval)
+	}
+	recorder.current.Messages++
+	recorder.current.Bytes += int64(size)
+	if recorder.latencies != nil {
+		recorder.latencies.Record(latency)
+	}
+}
+
+// flush closes the current window after elapsed and opens the next one.
+func (recorder *windowRecorder) flush(elapsed time.Duration) {
+	window := recorder.current
+	if elapsed > 0 {
+		window.Throughput = float64(window.Messages) / elapsed.Seconds()
+	}
+	if recorder.latencies != nil {
+		summary := recorder.latencies.Summary()
+		window.Latency = &summary
+		recorder.latencies.Reset()
+	}
+	recorder.windows = append(recorder.windows, window)
+
+	recorder.index++
+	recorder.current = Window{
+		Start: time.Unix(0, recorder.origin+recorder.index*int64(recorder.interval)),
+	}
+}
+
+// finish closes the last, possibly partial, window at stopped (unix
+// nanoseconds) and returns the series.
+func (recorder *windowRecorder) finish(stopped int64) []Window {
+	if recorder == nil || recorder.origin == 0 {
+		return nil
+	}
+	if recorder.current.Messages > 0 {
+		recorder.flush(time.Duration(stopped - recorder.current.Start.UnixNano()))
+	}
+	return recorder.windows
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+)
+
+// errUsage is returned once the flag set has already printed the problem.
+var errUsage = fmt.Errorf("usage error")
+
+var commands = []struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}{
+	{"produce", "publish messages at the configured rate", produceCommand},
+	{"consume", "receive messages and report throughput, loss and latency", consumeCommand},
+	{"run", "run producer and consumer in one process", runBothCommand},
+	{"scenario", "run the benchmark described in a YAML or JSON file", scenarioCommand},
+	{"report", "print the JSON reports of earlier runs", reportCommand},
+	{"compare", "compare two JSON reports", compareCommand},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s%s\n", command.name, command.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '<command> --help' for its flags. Flags override the environment variables\n"+
+		"named in their help. Without a command the test is configured from the environment only.\n")
+}
+
+// runCommand runs the named command and returns the exit code.
+func runCommand(name string, args []string) int {
+	switch name {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return 0
+	}
+	for _, command := range commands {
+		if command.name != name {
+			continue
+		}
+		err := command.run(args)
+		switch err {
+		case nil, flag.ErrHelp:
+			return 0
+		case errUsage:
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	return 2
+}
+
+// envFlags is a flag set whose flags stand in for environment variables.
+// Only flags given on the command line are written to the environment, the
+// rest keeps falling back to it.
+type envFlags struct {
+	*flag.FlagSet
+	env map[string]envFlag
+}
+
+type envFlag struct {
+	key   string
+	value func() (string, error)
+}
+
+func newEnvFlags(name, arguments, description string) *envFlags {
+	flags := &envFlags{
+		FlagSet: flag.NewFlagSet(name, flag.ContinueOnError),
+		env:     make(map[string]envFlag),
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n%s\n\nFlags:\n", filepath.Base(os.Args[0]), name, arguments, description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func (flags *envFlags) string(name, key, value, usage string) {
+	p := flags.String(name, value, fmt.Sprintf("%s (env %s)", usage, key))
+	flags.env[name] = envFlag{key, func() (string, error) { return *p, nil }}
+}
+
+func (flags *envFlags) int(name, key string, value int, usage string) {
+	p := flags.Int(name, value, fmt.Sprintf("%s (env %s)", usage, key))
+	flags.env[name] = envFlag{key, func() (string, error) { return strconv.Itoa(*p), nil }}
+}
+
+func (flags *envFlags) bool(name, key string, value bool, usage string) {
+	p := flags.Bool(name, value, fmt.Sprintf("%s (env %s)", usage, key))
+	flags.env[name] = envFlag{key, func() (string, error) { return strconv.FormatBool(*p), nil }}
+}
+
+// duration stores the flag in the environment as a number of units, e.g.
+// milliseconds for TEST_DURATION.
+func (flags *envFlags) duration(name, key string, unit, value time.Duration, usage string) {
+	p := flags.Duration(name, value, fmt.Sprintf("%s (env %s)", usage, key))
+	flags.env[name] = envFlag{key, func() (string, error) { return durationUnits(*p, unit) }}
+}
+
+// durationUnits formats d as a whole number of unit, the way the environment
+// variables take it.
+func durationUnits(d, unit time.Duration) (string, error) {
+	if d%unit != 0 {
+		return "", fmt.Errorf("%s is not a whole number of %s", d, unitName(unit))
+	}
+	return strconv.FormatInt(int64(d/unit), 10), nil
+}
+
+func unitName(unit time.Duration) string {
+	switch unit {
+	case time.Millisecond:
+		return "milliseconds"
+	case time.Microsecond:
+		return "microseconds"
+	}
+	return unit.String()
+}
+
+func (flags *envFlags) brokerFlags() {
+	flags.string("broker", "TEST", "nsq", "broker to test: "+strings.Join(brokers, ", "))
+	flags.string("connect", "MQ_CONNECTION_STRING", "", "broker address, the default depends on the broker")
+	flags.string("topic", "TOPIC_NAME", "default", "topic, subject, queue or channel name")
+	flags.duration("duration", "TEST_DURATION", time.Millisecond, 0, "how long the producer sends, consumers stop this long after the first message")
+	flags.int("count", "MESSAGE_COUNT", 0, "number of messages each producer sends, consumers stop once they got this many from every producer")
+	flags.string("report", "REPORT_FILE", "/var/log/mq_report.json", "JSON report path, empty disables it")
+	flags.duration("interval", "REPORT_INTERVAL_MS", time.Millisecond, time.Second, "time series window in the report, 0 disables it")
+	flags.string("metrics", "METRICS_ADDR", "", "serve Prometheus metrics on this address, e.g. :9100")
+}
+
+func (flags *envFlags) producerFlags() {
+	flags.int("size", "MSG_UNIFORM_SIZE", 1024, "message size in bytes")
+	flags.string("rate", "MSG_RATE_GENERATOR", "uniform", "rate generator: uniform or poisson")
+	flags.duration("delay", "MSG_UNIFORM_DELAY_US", time.Microsecond, time.Millisecond, "delay between messages of the uniform generator")
+	flags.duration("poisson-delay", "MSG_POISSON_AVG_DELAY", time.Microsecond, 500*time.Microsecond, "average delay between messages of the poisson generator")
+	flags.duration("warmup", "WARMUP_MS", time.Millisecond, 0, "send warmup messages, left out of the results, for this long first")
+	flags.bool("fin", "FIN_ENABLED", false, "send FIN messages when done")
+	flags.string("producer-id", "PRODUCER_ID", "", "32-bit producer ID, random by default")
+	flags.string("clock-sync", "CLOCK_SYNC_SERVER", "", "measure the consumer clock against the one served at this address")
+}
+
+func (flags *envFlags) consumerFlags() {
+	flags.int("producers", "PRODUCER_COUNT", 0, "producers that must finish before the consumer stops, 0 waits for every producer seen")
+	flags.string("trace", "TRACE_FILE", "", "write a CSV line per received message to this path")
+	flags.string("clock-sync-listen", "CLOCK_SYNC_LISTEN", "", "serve this clock to producers on another host, e.g. :7400")
+}
+
+// parse parses args and copies the flags that were given to the environment.
+func (flags *envFlags) parse(args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument %q\n", flags.Arg(0))
+		flags.Usage()
+		return errUsage
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		env, ok := flags.env[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		value, valueErr := env.value()
+		if valueErr != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value %q for flag -%s: %s\n", f.Value, f.Name, valueErr)
+			flags.Usage()
+			err = errUsage
+			return
+		}
+		os.Setenv(env.key, value)
+	})
+	return err
+}
+
+func produceCommand(args []string) error {
+	flags := newEnvFlags("produce", "[flags]", "Publish messages to the broker for --duration or until --count are sent.")
+	flags.brokerFlags()
+	flags.producerFlags()
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	os.Setenv("CLIENT_MODE", "producer")
+	return runTest()
+}
+
+func consumeCommand(args []string) error {
+	flags := newEnvFlags("consume", "[flags]", "Receive messages until every producer sent a FIN or --count messages, or\n"+
+		"--duration has passed since the first one.")
+	flags.brokerFlags()
+	flags.consumerFlags()
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	os.Setenv("CLIENT_MODE", "consumer")
+	return runTest()
+}
+
+func runBothCommand(args []string) error {
+	flags := newEnvFlags("run", "[flags]", "Run producer and consumer against the same broker in one process, so latency\n"+
+		"is measured with a single clock.")
+	flags.brokerFlags()
+	flags.producerFlags()
+	flags.consumerFlags()
+	flags.duration("setup-delay", "SETUP_DELAY_MS", time.Millisecond, time.Second, "time the consumer gets to subscribe before the producer starts")
+	if err := flags.parse(args); err != nil {
+		return err
+	}
+	// The consumer only stops early when it sees a FIN.
+	if _, ok := os.LookupEnv("FIN_ENABLED"); !ok {
+		os.Setenv("FIN_ENABLED", "true")
+	}
+	os.Setenv("CLIENT_MODE", "all")
+	return runTest()
+}
+
+// runTesters runs consumers and producers of the configured test side by side
+// in this process, each with a driver of its own. Consumers get setupDelay to
+// subscribe before the producers start.
+func runTesters(config testConfig, consumers, producers int, setupDelay time.Duration) error {
+	reportFile := getEnv("REPORT_FILE", "/var/log/mq_report.json")
+	traceFile := getEnv("TRACE_FILE", "")
+	// A fixed PRODUCER_ID is the first of consecutive IDs.
+	firstID, _ := strconv.ParseUint(getEnv("PRODUCER_ID", ""), 10, 32)
+
+	if consumers > 1 && config.subject == "zeromq" {
+		if pattern := getEnv("ZMQ_PATTERN", "pubsub"); pattern != "pubsub" && pattern != "proxy" {
+			return fmt.Errorf("ZMQ_PATTERN %s spreads the messages over the consumers, run one consumer per process", pattern)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, consumers+producers)
+	start := func(mode string, index int) error {
+		// Drivers read their settings when they are created.
+		// Producers create a handler as well, only consumers write the trace.
+		env := map[string]string{"TRACE_FILE": ""}
+		if mode == "consumer" {
+			env["TRACE_FILE"] = testerReportFile(traceFile, mode, index, consumers, producers)
+		}
+		if mode == "consumer" && consumers > 1 {
+			if key, group := consumerGroup(config.subject); key != "" {
+				env[key] = fmt.Sprintf("%s-%d", group, index+1)
+			}
+		}
+		var tester *benchmark.Tester
+		err := withEnv(env, func() (err error) {
+			tester, err = newTester(config.subject, config.testLatency, config.msgCount, config.msgSize, mode)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		tester.ReportFile = testerReportFile(reportFile, mode, index, consumers, producers)
+		if mode == "producer" && firstID != 0 {
+			tester.ProducerID = uint32(firstID) + uint32(index)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tester.Test(); err != nil {
+				errs <- err
+			}
+		}()
+		return nil
+	}
+
+	for i := 0; i < consumers; i++ {
+		if err := start("consumer", i); err != nil {
+			return err
+		}
+	}
+	if consumers > 0 && producers > 0 {
+		time.Sleep(setupDelay)
+	}
+	for i := 0; i < producers; i++ {
+		if err := start("producer", i); err != nil {
+			return err
+		}
+	}
+	// A failed tester ends the run, consumers would wait for its FIN forever.
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-done:
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// consumerGroup returns the setting that makes the consumers of subject share
+// the messages, and its value. Several consumers in one process each get their
+// own, or their delivery stats would each cover only part of the messages.
+func consumerGroup(subject string) (key, value string) {
+	switch subject {
+	case "nsq":
+		return "NSQ_CHANNEL", getEnv("NSQ_CHANNEL", "test")
+	case "kafka":
+		return "KAFKA_CONSUMER_GROUP", getEnv("KAFKA_CONSUMER_GROUP", "test")
+	case "redis-streams":
+		return "REDIS_CONSUMER_GROUP", getEnv("REDIS_CONSUMER_GROUP", "test")
+	case "amqp":
+		return "AMQP_QUEUE", getEnv("AMQP_QUEUE", getEnv("TOPIC_NAME", "default"))
+	case "nats":
+		// Without a queue group every subscriber gets every message.
+		if group := getEnv("NATS_QUEUE_GROUP", ""); group != "" {
+			return "NATS_QUEUE_GROUP", group
+		}
+	}
+	return "", ""
+}
+
+// withEnv runs fn with the environment variables of env set and restores them
+// afterwards.
+func withEnv(env map[string]string, fn func() error) error {
+	for key, value := range env {
+		previous, exists := os.LookupEnv(key)
+		os.Setenv(key, value)
+		if exists {
+			defer os.Setenv(key, previous)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+	return fn()
+}
+
+// testerReportFile keeps the reports of several testers apart. A single
+// consumer, or a lone producer, writes to path itself.
+func testerReportFile(path, mode string, index, consumers, producers int) string {
+	if path == "" {
+		return ""
+	}
+	if mode == "consumer" {
+		if consumers == 1 {
+			return path
+		}
+		return fmt.Sprintf("%s.consumer-%d", path, index+1)
+	}
+	switch {
+	case producers == 1 && consumers == 0:
+		return path
+	case producers == 1:
+		return path + ".producer"
+	}
+	return fmt.Sprintf("%s.producer-%d", path, index+1)
+}
+
+func reportCommand(args []string) error {
+	flags := newEnvFlags("report", "FILE...", "Print JSON reports. Latencies of several consumer reports are also merged.")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+	return printReports(os.Stdout, flags.Args())
+}
+
+func compareCommand(args []string) error {
+	flags := newEnvFlags("compare", "BASE CANDIDATE", "Compare throughput, loss and latency of two JSON reports.")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errUsage
+	}
+	return compareReports(os.Stdout, flags.Arg(0), flags.Arg(1))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDurationUnits(t *testing.T) {
+	tests := []struct {
+		d, unit time.Duration
+		want    string
+		wantErr bool
+	}{
+		{5 * time.Second, time.Millisecond, "5000", false},
+		{0, time.Millisecond, "0", false},
+		{1500 * time.Microsecond, time.Millisecond, "", true},
+		{1500 * time.Microsecond, time.Microsecond, "1500", false},
+		{time.Nanosecond, time.Microsecond, "", true},
+	}
+	for _, test := range tests {
+		got, err := durationUnits(test.d, test.unit)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s in %s: got %q, want an error", test.d, unitName(test.unit), got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s in %s: got %q (%v), want %q", test.d, unitName(test.unit), got, err, test.want)
+		}
+	}
+}
+
+func TestEnvFlagsParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr error
+	}{
+		{
+			name: "durations in units",
+			args: []string{"--duration", "5s", "--delay", "250us", "--warmup", "1m"},
+			want: map[string]string{"TEST_DURATION": "5000", "MSG_UNIFORM_DELAY_US": "250", "WARMUP_MS": "60000"},
+		},
+		{
+			name: "plain values",
+			args: []string{"--broker", "kafka", "--count", "10", "--fin", "--size", "256"},
+			want: map[string]string{"TEST": "kafka", "MESSAGE_COUNT": "10", "FIN_ENABLED": "true", "MSG_UNIFORM_SIZE": "256"},
+		},
+		{
+			name: "unset flags keep the environment",
+			args: []string{"--size", "256"},
+			want: map[string]string{"TEST_DURATION": "unchanged"},
+		},
+		{name: "not whole milliseconds", args: []string{"--duration", "1500us"}, wantErr: errUsage},
+		{name: "not whole microseconds", args: []string{"--delay", "1500ns"}, wantErr: errUsage},
+		{name: "not a duration", args: []string{"--duration", "5"}, wantErr: errUsage},
+		{name: "unknown flag", args: []string{"--rate-limit", "5"}, wantErr: errUsage},
+		{name: "argument", args: []string{"nsq"}, wantErr: errUsage},
+		{name: "help", args: []string{"--help"}, wantErr: flag.ErrHelp},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key := range test.want {
+				t.Setenv(key, "unchanged")
+			}
+			flags := newEnvFlags("produce", "[flags]", "test")
+			flags.brokerFlags()
+			flags.producerFlags()
+			flags.SetOutput(io.Discard)
+			flags.Usage = func() {}
+
+			if err := flags.parse(test.args); err != test.wantErr {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			for key, value := range test.want {
+				if got := os.Getenv(key); got != value {
+					t.Errorf("%s=%q, want %q", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestConsumerGroup(t *testing.T) {
+	t.Setenv("TOPIC_NAME", "orders")
+	tests := []struct {
+		subject, key, value string
+	}{
+		{"nsq", "NSQ_CHANNEL", "test"},
+		{"kafka", "KAFKA_CONSUMER_GROUP", "test"},
+		{"redis-streams", "REDIS_CONSUMER_GROUP", "test"},
+		{"amqp", "AMQP_QUEUE", "orders"},
+		{"nats", "", ""},
+		{"mqtt", "", ""},
+	}
+	for _, test := range tests {
+		if key, value := consumerGroup(test.subject); key != test.key || value != test.value {
+			t.Errorf("%s: %s=%q, want %s=%q", test.subject, key, value, test.key, test.value)
+		}
+	}
+
+	t.Setenv("NSQ_CHANNEL", "bench")
+	t.Setenv("KAFKA_CONSUMER_GROUP", "")
+	os.Unsetenv("KAFKA_CONSUMER_GROUP")
+	withEnv(map[string]string{"NSQ_CHANNEL": "bench-2", "KAFKA_CONSUMER_GROUP": "test-2"}, func() error {
+		if os.Getenv("NSQ_CHANNEL") != "bench-2" || os.Getenv("KAFKA_CONSUMER_GROUP") != "test-2" {
+			t.Error("environment not set")
+		}
+		return nil
+	})
+	if os.Getenv("NSQ_CHANNEL") != "bench" {
+		t.Errorf("NSQ_CHANNEL=%q, want it restored", os.Getenv("NSQ_CHANNEL"))
+	}
+	if _, exists := os.LookupEnv("KAFKA_CONSUMER_GROUP"); exists {
+		t.Error("KAFKA_CONSUMER_GROUP left set")
+	}
+}
@@ -1,42 +1,92 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
 	"github.com/green-lantern-id/mq-benchmarking/benchmark/mq"
 )
 
-func newTester(subject string, testLatency bool, msgCount, msgSize int, mode string) *benchmark.Tester {
+func newTester(subject string, testLatency bool, msgCount, msgSize int, mode string) (*benchmark.Tester, error) {
 	var messageSender benchmark.MessageSender
 	var messageReceiver benchmark.MessageReceiver
 
 	log.Printf("Testing %s", subject)
 
+	var err error
 	switch subject {
 	case "nsq":
-		nsq := mq.NewNsq(msgCount, mode)
+		var nsq *mq.Nsq
+		nsq, err = mq.NewNsq(msgCount, mode)
 		messageSender = nsq
 		messageReceiver = nsq
 	case "zeromq":
-		zeromq := mq.NewZeromq(msgCount, mode)
+		var zeromq *mq.Zeromq
+		zeromq, err = mq.NewZeromq(msgCount, mode)
 		messageSender = zeromq
 		messageReceiver = zeromq
+	case "kafka":
+		var kafka *mq.Kafka
+		kafka, err = mq.NewKafka(msgCount, mode)
+		messageSender = kafka
+		messageReceiver = kafka
+	case "amqp":
+		var amqp *mq.Amqp
+		amqp, err = mq.NewAmqp(msgCount, mode)
+		messageSender = amqp
+		messageReceiver = amqp
+	case "nats":
+		var nats *mq.Nats
+		nats, err = mq.NewNats(msgCount, mode)
+		messageSender = nats
+		messageReceiver = nats
+	case "jetstream":
+		var jetStream *mq.JetStream
+		jetStream, err = mq.NewJetStream(msgCount, mode)
+		messageSender = jetStream
+		messageReceiver = jetStream
+	case "redis-streams":
+		var redisStreams *mq.RedisStreams
+		redisStreams, err = mq.NewRedisStreams(msgCount, mode)
+		messageSender = redisStreams
+		messageReceiver = redisStreams
+	case "redis-pubsub":
+		var redisPubSub *mq.RedisPubSub
+		redisPubSub, err = mq.NewRedisPubSub(msgCount, mode)
+		messageSender = redisPubSub
+		messageReceiver = redisPubSub
+	case "mqtt":
+		var mqtt *mq.Mqtt
+		mqtt, err = mq.NewMqtt(msgCount, mode)
+		messageSender = mqtt
+		messageReceiver = mqtt
+	case "loopback":
+		var loopback *mq.Loopback
+		loopback, err = mq.NewLoopback(msgCount, mode)
+		messageSender = loopback
+		messageReceiver = loopback
 	default:
-		return nil
+		return nil, fmt.Errorf("unknown TEST %q", subject)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", subject, err)
 	}
 
 	return &benchmark.Tester{
-		subject,
-		msgSize,
-		msgCount,
-		testLatency,
-		messageSender,
-		messageReceiver,
-		mode,
-	}
+		Name:            subject,
+		MessageSize:     msgSize,
+		MessageCount:    msgCount,
+		TestLatency:     testLatency,
+		MessageSender:   messageSender,
+		MessageReceiver: messageReceiver,
+		Mode:            mode,
+		ReportFile:      getEnv("REPORT_FILE", "/var/log/mq_report.json"),
+	}, nil
 }
 
 func getEnv(key, defaultValue string) string {
@@ -47,26 +97,185 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-func parseEnv() (string, bool, int, int, string) {
-	test := getEnv("TEST", "nsq")
-	messageCount, err := strconv.Atoi(getEnv("MESSAGE_COUNT", "0"))
-	messageSize, err := strconv.Atoi(getEnv("MESSAGE_SIZE", "1024"))
-	mode := getEnv("CLIENT_MODE", "consumer") // consumer vs producer
-	testLatency, err := strconv.ParseBool(getEnv("TEST_LATENCY", "false"))
+// brokers are the values accepted for TEST.
+var brokers = []string{"nsq", "zeromq", "kafka", "amqp", "nats", "jetstream", "redis-streams", "redis-pubsub", "mqtt", "loopback"}
 
+type testConfig struct {
+	subject     string
+	testLatency bool
+	msgCount    int
+	msgSize     int
+	mode        string
+}
+
+// parseEnv reads and validates the test configuration. Command line flags
+// end up in the environment as well, so both are checked here.
+func parseEnv() (testConfig, error) {
+	config := testConfig{
+		subject: getEnv("TEST", "nsq"),
+		mode:    getEnv("CLIENT_MODE", "consumer"), // consumer vs producer vs all (vs proxy for zeromq)
+	}
+	if !contains(brokers, config.subject) {
+		return config, fmt.Errorf("unknown TEST %q, expected one of %s", config.subject, strings.Join(brokers, ", "))
+	}
+	switch config.mode {
+	case "consumer", "producer", "all":
+	case "proxy":
+		if config.subject != "zeromq" {
+			return config, fmt.Errorf("CLIENT_MODE proxy is only supported with TEST=zeromq")
+		}
+	default:
+		return config, fmt.Errorf("unknown CLIENT_MODE %q, expected consumer, producer, all or proxy", config.mode)
+	}
+	if config.subject == "loopback" && config.mode != "all" {
+		return config, fmt.Errorf("loopback delivers within the process, it needs CLIENT_MODE all")
+	}
+
+	var err error
+	if config.msgCount, err = envInt("MESSAGE_COUNT", "0"); err != nil {
+		return config, err
+	}
+	if config.msgSize, err = envInt("MESSAGE_SIZE", "1024"); err != nil {
+		return config, err
+	}
+	if config.testLatency, err = envBool("TEST_LATENCY", "false"); err != nil {
+		return config, err
+	}
+	duration, err := envInt("TEST_DURATION", "0")
 	if err != nil {
-		log.Printf("[ERROR] Cannot get environment variables %s", err)
+		return config, err
+	}
+	if _, err := envBool("FIN_ENABLED", "false"); err != nil {
+		return config, err
+	}
+	if _, err := envInt("REPORT_INTERVAL_MS", "1000"); err != nil {
+		return config, err
+	}
+	if latency, err := envInt("HISTOGRAM_MAX_LATENCY_MS", "60000"); err != nil {
+		return config, err
+	} else if latency == 0 {
+		return config, fmt.Errorf("HISTOGRAM_MAX_LATENCY_MS must be positive")
+	}
+	if sigfigs, err := envInt("HISTOGRAM_SIGFIGS", "3"); err != nil {
+		return config, err
+	} else if sigfigs < 1 || sigfigs > 5 {
+		return config, fmt.Errorf("HISTOGRAM_SIGFIGS must be between 1 and 5, got %d", sigfigs)
+	}
+	if config.mode == "all" {
+		if _, err := envInt("SETUP_DELAY_MS", "1000"); err != nil {
+			return config, err
+		}
+	}
+	if _, err := envInt("PRODUCER_COUNT", "0"); err != nil {
+		return config, err
+	}
+	if benchmark.Consumes(config.mode) && getEnv("TRACE_FILE", "") != "" {
+		if _, err := envInt("TRACE_BUFFER_SIZE", "65536"); err != nil {
+			return config, err
+		}
+	}
+	if config.mode == "producer" && getEnv("CLOCK_SYNC_SERVER", "") != "" {
+		if samples, err := envInt("CLOCK_SYNC_SAMPLES", "8"); err != nil {
+			return config, err
+		} else if samples == 0 {
+			return config, fmt.Errorf("CLOCK_SYNC_SAMPLES must be positive")
+		}
+		if _, err := envInt("CLOCK_SYNC_INTERVAL_MS", "1000"); err != nil {
+			return config, err
+		}
+	}
+	if !benchmark.Produces(config.mode) {
+		return config, nil
 	}
 
-	return test, testLatency, messageCount, messageSize, mode
+	if duration == 0 && config.msgCount == 0 {
+		return config, fmt.Errorf("TEST_DURATION or MESSAGE_COUNT must be set for a producer")
+	}
+	if _, err := envInt("WARMUP_MS", "0"); err != nil {
+		return config, err
+	}
+	if size, err := envInt("MSG_UNIFORM_SIZE", "1024"); err != nil {
+		return config, err
+	} else if size == 0 {
+		return config, fmt.Errorf("MSG_UNIFORM_SIZE must be positive")
+	}
+	switch generator := getEnv("MSG_RATE_GENERATOR", "uniform"); generator {
+	case "uniform":
+		_, err = envInt("MSG_UNIFORM_DELAY_US", "1000")
+	case "poisson":
+		var delay float64
+		delay, err = strconv.ParseFloat(getEnv("MSG_POISSON_AVG_DELAY", "500.0"), 64)
+		if err != nil || delay <= 0 {
+			err = fmt.Errorf("MSG_POISSON_AVG_DELAY must be a positive number of microseconds")
+		}
+	default:
+		err = fmt.Errorf("unknown MSG_RATE_GENERATOR %q, expected uniform or poisson", generator)
+	}
+	return config, err
 }
 
-func main() {
+// envInt reads a non-negative integer.
+func envInt(key, defaultValue string) (int, error) {
+	value, err := strconv.Atoi(getEnv(key, defaultValue))
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", key, getEnv(key, defaultValue))
+	}
+	return value, nil
+}
+
+func envBool(key, defaultValue string) (bool, error) {
+	value, err := strconv.ParseBool(getEnv(key, defaultValue))
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %q", key, getEnv(key, defaultValue))
+	}
+	return value, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// runTest runs one side of a test as configured in the environment.
+func runTest() error {
+	config, err := parseEnv()
+	if err != nil {
+		return err
+	}
+	if config.mode == "proxy" {
+		mq.RunZeromqProxy()
+		return fmt.Errorf("zeromq proxy stopped")
+	}
+
+	metrics.Serve(getEnv("METRICS_ADDR", ""))
+	if config.mode == "consumer" {
+		listener, err := benchmark.ServeClockSync(getEnv("CLOCK_SYNC_LISTEN", ""))
+		if err != nil {
+			return err
+		}
+		if listener != nil {
+			defer listener.Close()
+		}
+	}
 
-	tester := newTester(parseEnv())
-	if tester == nil {
-		os.Exit(1)
+	tester, err := newTester(config.subject, config.testLatency, config.msgCount, config.msgSize, config.mode)
+	if err != nil {
+		return err
 	}
+	return tester.Test()
+}
 
-	tester.Test()
+func main() {
+	// Without a command everything is configured through the environment, as
+	// in the Docker image.
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	if err := runTest(); err != nil {
+		log.Fatalf("[ERROR] %s", err)
+	}
 }
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"unknown TEST", map[string]string{"TEST": "rabbitmq"}, true},
+		{"unknown CLIENT_MODE", map[string]string{"CLIENT_MODE": "both"}, true},
+		{"proxy without zeromq", map[string]string{"CLIENT_MODE": "proxy"}, true},
+		{"zeromq proxy", map[string]string{"TEST": "zeromq", "CLIENT_MODE": "proxy"}, false},
+		{"loopback consumer", map[string]string{"TEST": "loopback"}, true},
+		{"producer without TEST_DURATION", map[string]string{"CLIENT_MODE": "producer"}, true},
+		{"producer with TEST_DURATION", map[string]string{"CLIENT_MODE": "producer", "TEST_DURATION": "1000"}, false},
+		{"producer with MESSAGE_COUNT", map[string]string{"CLIENT_MODE": "producer", "MESSAGE_COUNT": "100"}, false},
+		{"consumer without TEST_DURATION", map[string]string{"CLIENT_MODE": "consumer"}, false},
+		{"TEST_DURATION as a duration", map[string]string{"CLIENT_MODE": "producer", "TEST_DURATION": "1s"}, true},
+		{"negative MESSAGE_COUNT", map[string]string{"MESSAGE_COUNT": "-1"}, true},
+		{"FIN_ENABLED", map[string]string{"FIN_ENABLED": "maybe"}, true},
+		{"HISTOGRAM_SIGFIGS", map[string]string{"HISTOGRAM_SIGFIGS": "6"}, true},
+		{"HISTOGRAM_MAX_LATENCY_MS", map[string]string{"HISTOGRAM_MAX_LATENCY_MS": "0"}, true},
+		{"SETUP_DELAY_MS", map[string]string{"TEST": "loopback", "CLIENT_MODE": "all", "TEST_DURATION": "100", "SETUP_DELAY_MS": "1s"}, true},
+		{"TRACE_BUFFER_SIZE", map[string]string{"TRACE_FILE": "trace.csv", "TRACE_BUFFER_SIZE": "big"}, true},
+		{"unknown MSG_RATE_GENERATOR", map[string]string{"CLIENT_MODE": "producer", "TEST_DURATION": "1000", "MSG_RATE_GENERATOR": "burst"}, true},
+		{"poisson without delay", map[string]string{"CLIENT_MODE": "producer", "TEST_DURATION": "1000", "MSG_RATE_GENERATOR": "poisson", "MSG_POISSON_AVG_DELAY": "0"}, true},
+		{"empty message size", map[string]string{"CLIENT_MODE": "producer", "TEST_DURATION": "1000", "MSG_UNIFORM_SIZE": "0"}, true},
+		{"producer setting on a consumer", map[string]string{"MSG_UNIFORM_SIZE": "0"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			_, err := parseEnv()
+			if test.wantErr && err == nil {
+				t.Error("no error")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
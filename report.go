@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+)
+
+func printReports(w io.Writer, paths []string) error {
+	var merged *benchmark.LatencyHistogram
+	consumers := 0
+	for _, path := range paths {
+		report, err := benchmark.ReadReport(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		fmt.Fprintf(w, "== %s\n", path)
+		printReport(w, report)
+		fmt.Fprintln(w)
+
+		if report.Consumer == nil || report.Consumer.LatencyHistogram == nil {
+			continue
+		}
+		consumers++
+		if merged == nil {
+			merged = report.Consumer.LatencyHistogram
+		} else {
+			merged.Merge(report.Consumer.LatencyHistogram)
+		}
+	}
+	if consumers > 1 {
+		fmt.Fprintf(w, "== %d consumers merged\nlatency: %s\n", consumers, merged.Summary())
+	}
+	return nil
+}
+
+func printReport(w io.Writer, report *benchmark.Report) {
+	fmt.Fprintf(w, "broker %s, mode %s, version %s\n", report.Broker, report.Mode, report.Version)
+	fmt.Fprintf(w, "host %s (%s/%s, %d cpus, %s)\n", report.Host.Hostname, report.Host.OS, report.Host.Arch,
+		report.Host.CPUs, report.Host.GoVersion)
+	fmt.Fprintf(w, "started %s, stopped %s\n", report.Started.Format("2006-01-02 15:04:05"),
+		report.Stopped.Format("2006-01-02 15:04:05"))
+
+	if len(report.Options) > 0 {
+		keys := make([]string, 0, len(report.Options))
+		for key := range report.Options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "options:")
+		for _, key := range keys {
+			fmt.Fprintf(w, " %s=%s", key, report.Options[key])
+		}
+		fmt.Fprintln(w)
+	}
+
+	if generator := report.Generator; generator != nil {
+		delay := fmt.Sprintf("delay %d us", generator.DelayUs)
+		if generator.Rate == "poisson" {
+			delay = fmt.Sprintf("average delay %f us", generator.PoissonAvgDelayUs)
+		}
+		fmt.Fprintf(w, "generator: %s rate, %s, size %d bytes, %d ms, fin %t\n", generator.Rate, delay,
+			generator.MessageSize, generator.DurationMs, generator.FinEnabled)
+	}
+
+	if producer := report.Producer; producer != nil {
+		fmt.Fprintf(w, "producer %d: sent %d messages, %d bytes, %f msg per second\n", producer.ProducerID,
+			producer.Messages, producer.Bytes, producer.Throughput)
+		printWindows(w, producer.Windows)
+		if producer.PublishLatency != nil {
+			fmt.Fprintf(w, "publish latency: %s, %d errors\n", producer.PublishLatency, producer.PublishErrors)
+		}
+		if producer.Clock != nil {
+			fmt.Fprintf(w, "consumer clock: %s\n", producer.Clock)
+		}
+	}
+
+	if driver := report.Driver; driver != nil {
+		keys := make([]string, 0, len(driver.Counters))
+		for key := range driver.Counters {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "driver:")
+		for _, key := range keys {
+			fmt.Fprintf(w, " %s %d", key, driver.Counters[key])
+		}
+		fmt.Fprintln(w)
+		for name, latency := range driver.Latencies {
+			fmt.Fprintf(w, "%s latency: %s\n", name, latency)
+		}
+		for _, note := range driver.Notes {
+			fmt.Fprintf(w, "note: %s\n", note)
+		}
+	}
+
+	if consumer := report.Consumer; consumer != nil {
+		fmt.Fprintf(w, "consumer: received %d messages, %d bytes, %f msg per second, %d invalid\n",
+			consumer.Messages, consumer.Bytes, consumer.Throughput, consumer.Invalid)
+		delivery := consumer.Delivery
+		fmt.Fprintf(w, "lost %d of %d (%f%%), duplicates %d, out of order %d\n", delivery.Lost, delivery.Expected,
+			delivery.LossRate()*100, delivery.Duplicates, delivery.Reordered)
+		fmt.Fprintf(w, "latency: %s\n", consumer.Latency)
+		fmt.Fprintf(w, "response latency: %s\n", consumer.ResponseLatency)
+		if consumer.NegativeLatencies > 0 || consumer.OverflowLatencies > 0 ||
+			consumer.ResponseNegativeLatencies > 0 || consumer.ResponseOverflowLatencies > 0 {
+			fmt.Fprintf(w, "clamped latencies: %d below zero, %d above maximum; response %d below zero, %d above maximum\n",
+				consumer.NegativeLatencies, consumer.OverflowLatencies,
+				consumer.ResponseNegativeLatencies, consumer.ResponseOverflowLatencies)
+		}
+		if trace := consumer.Trace; trace != nil {
+			fmt.Fprintf(w, "trace: %d records in %s, %d dropped\n", trace.Records, trace.File, trace.Dropped)
+		}
+		printWindows(w, consumer.Windows)
+		for id, clock := range consumer.Clocks {
+			fmt.Fprintf(w, "clock of producer %d: %s\n", id, clock)
+		}
+		if consumer.ClockUncorrected > 0 {
+			fmt.Fprintf(w, "%d messages with uncorrected latency\n", consumer.ClockUncorrected)
+		}
+		if consumer.ClockIgnored > 0 {
+			fmt.Fprintf(w, "%d outdated clock estimates ignored\n", consumer.ClockIgnored)
+		}
+		if len(consumer.ClockMissing) > 0 {
+			fmt.Fprintf(w, "no clock estimate from producers %v\n", consumer.ClockMissing)
+		}
+	}
+}
+
+// printWindows sums up the time series by its slowest and fastest window.
+func printWindows(w io.Writer, windows []benchmark.Window) {
+	if len(windows) == 0 {
+		return
+	}
+	slowest, fastest := windows[0], windows[0]
+	for _, window := range windows {
+		if window.Throughput < slowest.Throughput {
+			slowest = window
+		}
+		if window.Throughput > fastest.Throughput {
+			fastest = window
+		}
+	}
+	fmt.Fprintf(w, "%d windows, throughput %f msg per second at %s to %f at %s\n", len(windows),
+		slowest.Throughput, slowest.Start.Format("15:04:05"), fastest.Throughput, fastest.Start.Format("15:04:05"))
+}
+
+// comparedMetrics are the rows of compare. A metric returns false when the
+// report does not have it.
+var comparedMetrics = []struct {
+	name  string
+	value func(*benchmark.Report) (float64, bool)
+}{
+	{"producer msg/s", func(r *benchmark.Report) (float64, bool) {
+		if r.Producer == nil {
+			return 0, false
+		}
+		return r.Producer.Throughput, true
+	}},
+	{"publish p99 ms", func(r *benchmark.Report) (float64, bool) {
+		if r.Producer == nil || r.Producer.PublishLatency == nil {
+			return 0, false
+		}
+		return r.Producer.PublishLatency.P99, true
+	}},
+	{"consumer msg/s", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Throughput })},
+	{"loss %", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Delivery.LossRate() * 100 })},
+	{"duplicates %", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Delivery.DuplicateRate() * 100 })},
+	{"latency p50 ms", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Latency.P50 })},
+	{"latency p90 ms", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Latency.P90 })},
+	{"latency p99 ms", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Latency.P99 })},
+	{"latency p99.9 ms", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Latency.P999 })},
+	{"latency max ms", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.Latency.Max })},
+	{"response p99 ms", consumerMetric(func(c *benchmark.ConsumerResult) float64 { return c.ResponseLatency.P99 })},
+}
+
+func consumerMetric(value func(*benchmark.ConsumerResult) float64) func(*benchmark.Report) (float64, bool) {
+	return func(r *benchmark.Report) (float64, bool) {
+		if r.Consumer == nil {
+			return 0, false
+		}
+		return value(r.Consumer), true
+	}
+}
+
+func compareReports(w io.Writer, basePath, candidatePath string) error {
+	base, err := benchmark.ReadReport(basePath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", basePath, err)
+	}
+	candidate, err := benchmark.ReadReport(candidatePath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", candidatePath, err)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(table, "\t%s (%s)\t%s (%s)\tchange\t\n", basePath, base.Broker, candidatePath, candidate.Broker)
+	for _, metric := range comparedMetrics {
+		baseValue, baseOk := metric.value(base)
+		candidateValue, candidateOk := metric.value(candidate)
+		if !baseOk && !candidateOk {
+			continue
+		}
+		change := "-"
+		if baseOk && candidateOk && baseValue != 0 {
+			change = fmt.Sprintf("%+.1f%%", (candidateValue-baseValue)/baseValue*100)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t\n", metric.name, formatMetric(baseValue, baseOk),
+			formatMetric(candidateValue, candidateOk), change)
+	}
+	return table.Flush()
+}
+
+func formatMetric(value float64, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f", value)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/green-lantern-id/mq-benchmarking/benchmark"
+	"github.com/green-lantern-id/mq-benchmarking/benchmark/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+// scenario describes a whole benchmark in a YAML or JSON file. Every field
+// ends up in the environment variable of the same meaning, fields left out
+// fall back to the environment.
+type scenario struct {
+	Broker  string `json:"broker" yaml:"broker"`
+	Connect string `json:"connect" yaml:"connect"`
+	Topic   string `json:"topic" yaml:"topic"`
+	// Options are further environment variables, usually the driver's own
+	// such as NSQ_PUBLISH_MODE.
+	Options   map[string]interface{} `json:"options" yaml:"options"`
+	Producers int                    `json:"producers" yaml:"producers"`
+	Consumers int                    `json:"consumers" yaml:"consumers"`
+	Rate      scenarioRate           `json:"rate" yaml:"rate"`
+	Size      int                    `json:"size" yaml:"size"`
+	Duration  string                 `json:"duration" yaml:"duration"`
+	Count     int                    `json:"count" yaml:"count"`
+	Warmup    string                 `json:"warmup" yaml:"warmup"`
+	Fin       *bool                  `json:"fin" yaml:"fin"`
+	Output    scenarioOutput         `json:"output" yaml:"output"`
+}
+
+type scenarioRate struct {
+	Generator    string `json:"generator" yaml:"generator"`
+	Delay        string `json:"delay" yaml:"delay"`
+	AverageDelay string `json:"average_delay" yaml:"average_delay"`
+}
+
+type scenarioOutput struct {
+	Report   string `json:"report" yaml:"report"`
+	Trace    string `json:"trace" yaml:"trace"`
+	Interval string `json:"interval" yaml:"interval"`
+	Metrics  string `json:"metrics" yaml:"metrics"`
+}
+
+// loadScenario reads a scenario, as JSON when the file ends in .json and as
+// YAML otherwise. Unknown fields are errors, a typo should not silently fall
+// back to a default.
+func loadScenario(path string) (*scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{Producers: 1, Consumers: 1}
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(s)
+	} else {
+		err = yaml.UnmarshalStrict(data, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if s.Producers < 0 || s.Consumers < 0 || s.Producers+s.Consumers == 0 {
+		return nil, fmt.Errorf("%s: needs at least one producer or consumer", path)
+	}
+	return s, nil
+}
+
+// apply copies the scenario into the environment.
+func (s *scenario) apply() error {
+	values := map[string]string{
+		"TEST":                 s.Broker,
+		"MQ_CONNECTION_STRING": s.Connect,
+		"TOPIC_NAME":           s.Topic,
+		"MSG_RATE_GENERATOR":   s.Rate.Generator,
+		"REPORT_FILE":          s.Output.Report,
+		"TRACE_FILE":           s.Output.Trace,
+		"METRICS_ADDR":         s.Output.Metrics,
+	}
+	if s.Size != 0 {
+		values["MSG_UNIFORM_SIZE"] = strconv.Itoa(s.Size)
+	}
+	if s.Count != 0 {
+		values["MESSAGE_COUNT"] = strconv.Itoa(s.Count)
+	}
+	if s.Producers != 0 {
+		values["PRODUCER_COUNT"] = strconv.Itoa(s.Producers)
+	}
+	if s.Fin != nil {
+		values["FIN_ENABLED"] = strconv.FormatBool(*s.Fin)
+	}
+
+	durations := []struct {
+		key   string
+		value string
+		unit  time.Duration
+	}{
+		{"TEST_DURATION", s.Duration, time.Millisecond},
+		{"WARMUP_MS", s.Warmup, time.Millisecond},
+		{"MSG_UNIFORM_DELAY_US", s.Rate.Delay, time.Microsecond},
+		{"MSG_POISSON_AVG_DELAY", s.Rate.AverageDelay, time.Microsecond},
+		{"REPORT_INTERVAL_MS", s.Output.Interval, time.Millisecond},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q for %s: %s", d.value, d.key, err)
+		}
+		if values[d.key], err = durationUnits(duration, d.unit); err != nil {
+			return fmt.Errorf("invalid duration %q for %s: %s", d.value, d.key, err)
+		}
+	}
+
+	for key, value := range s.Options {
+		if _, ok := values[key]; ok {
+			return fmt.Errorf("option %s is already set by the scenario", key)
+		}
+		values[key] = fmt.Sprint(value)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		os.Setenv(key, values[key])
+	}
+	return nil
+}
+
+func scenarioCommand(args []string) error {
+	flags := newEnvFlags("scenario", "[flags] FILE", "Run the benchmark described in a YAML or JSON scenario file.\n"+
+		"Several testers write their reports next to the report file with .consumer-N and .producer-N suffixes.")
+	only := flags.String("only", "", "run only the \"producers\" or the \"consumers\" of the scenario, e.g. one side per host")
+	setupDelay := flags.Duration("setup-delay", time.Second, "time the consumers get to subscribe before the producers start")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUsage
+	}
+
+	s, err := loadScenario(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	// Consumers wait for the producers of the whole scenario, so the
+	// environment is set before one side is left out.
+	if err := s.apply(); err != nil {
+		return err
+	}
+	switch *only {
+	case "":
+	case "producers":
+		s.Consumers = 0
+	case "consumers":
+		s.Producers = 0
+	default:
+		return fmt.Errorf("--only must be producers or consumers, got %q", *only)
+	}
+
+	// One producer and one consumer share a tester, and so the clock.
+	if s.Producers == 1 && s.Consumers == 1 {
+		os.Setenv("CLIENT_MODE", "all")
+		os.Setenv("SETUP_DELAY_MS", strconv.FormatInt(setupDelay.Milliseconds(), 10))
+		return runTest()
+	}
+
+	if getEnv("TEST", "nsq") == "loopback" {
+		return fmt.Errorf("loopback delivers within the process, use one producer and one consumer")
+	}
+
+	// Validate the producer settings whenever there are producers.
+	if s.Producers > 0 {
+		os.Setenv("CLIENT_MODE", "producer")
+	} else {
+		os.Setenv("CLIENT_MODE", "consumer")
+	}
+	config, err := parseEnv()
+	if err != nil {
+		return err
+	}
+
+	metrics.Serve(getEnv("METRICS_ADDR", ""))
+	if s.Consumers > 0 {
+		listener, err := benchmark.ServeClockSync(getEnv("CLOCK_SYNC_LISTEN", ""))
+		if err != nil {
+			return err
+		}
+		if listener != nil {
+			defer listener.Close()
+		}
+	}
+	return runTesters(config, s.Consumers, s.Producers, *setupDelay)
+}
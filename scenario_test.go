@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// scenarioKeys are the variables apply may set, restored after each test.
+var scenarioKeys = []string{
+	"TEST", "MQ_CONNECTION_STRING", "TOPIC_NAME", "MSG_RATE_GENERATOR", "REPORT_FILE", "TRACE_FILE",
+	"METRICS_ADDR", "MSG_UNIFORM_SIZE", "MESSAGE_COUNT", "PRODUCER_COUNT", "FIN_ENABLED", "TEST_DURATION",
+	"WARMUP_MS", "MSG_UNIFORM_DELAY_US", "MSG_POISSON_AVG_DELAY", "REPORT_INTERVAL_MS", "NSQ_PUBLISH_MODE",
+}
+
+// keepEnv restores keys when the test ends and starts the test without them.
+func keepEnv(t *testing.T, keys ...string) {
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func writeScenario(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScenario(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		// err is part of the error expected, empty for none.
+		err string
+	}{
+		{"yaml", "nsq.yaml", "broker: nsq\nproducers: 2\nrate:\n  generator: uniform\n  delay: 500us\n", ""},
+		{"json", "nsq.json", `{"broker": "nsq", "producers": 2, "rate": {"generator": "uniform", "delay": "500us"}}`, ""},
+		{"unknown yaml field", "nsq.yaml", "broker: nsq\nduraton: 5s\n", "duraton"},
+		{"unknown nested yaml field", "nsq.yaml", "rate:\n  dealy: 5ms\n", "dealy"},
+		{"unknown json field", "nsq.json", `{"broker": "nsq", "duraton": "5s"}`, "duraton"},
+		{"unknown nested json field", "nsq.json", `{"rate": {"dealy": "5ms"}}`, "dealy"},
+		{"yml is yaml", "nsq.yml", "broker: nsq\n", ""},
+		{"json read as yaml", "nsq.txt", `{"broker": "nsq"}`, ""},
+		{"wrong type", "nsq.yaml", "producers: two\n", "nsq.yaml"},
+		{"nobody", "nsq.yaml", "producers: 0\nconsumers: 0\n", "at least one producer or consumer"},
+		{"negative", "nsq.yaml", "producers: -1\n", "at least one producer or consumer"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := loadScenario(writeScenario(t, test.file, test.content))
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if s.Broker != "nsq" || s.Consumers != 1 {
+					t.Errorf("scenario %+v, want broker nsq and the default consumer", s)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want one about %q", err, test.err)
+			}
+		})
+	}
+
+	if _, err := loadScenario(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
+
+func TestScenarioApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		err     string
+	}{
+		{
+			name: "durations in the units of the environment",
+			content: "duration: 1m\nwarmup: 1500ms\nrate:\n  delay: 2ms\n  average_delay: 250us\n" +
+				"output:\n  interval: 10s\n",
+			want: map[string]string{
+				"TEST_DURATION": "60000", "WARMUP_MS": "1500", "MSG_UNIFORM_DELAY_US": "2000",
+				"MSG_POISSON_AVG_DELAY": "250", "REPORT_INTERVAL_MS": "10000",
+			},
+		},
+		{
+			name:    "plain fields",
+			content: "broker: kafka\ntopic: orders\nsize: 256\ncount: 100\nproducers: 3\nfin: false\n",
+			want: map[string]string{
+				"TEST": "kafka", "TOPIC_NAME": "orders", "MSG_UNIFORM_SIZE": "256", "MESSAGE_COUNT": "100",
+				"PRODUCER_COUNT": "3", "FIN_ENABLED": "false",
+			},
+		},
+		{
+			name:    "fields left out keep the environment",
+			content: "broker: nsq\n",
+			want:    map[string]string{"TEST_DURATION": "", "FIN_ENABLED": ""},
+		},
+		{
+			name:    "options",
+			content: "options:\n  NSQ_PUBLISH_MODE: multi\n",
+			want:    map[string]string{"NSQ_PUBLISH_MODE": "multi"},
+		},
+		{name: "not whole milliseconds", content: "duration: 1500us\n", err: "TEST_DURATION"},
+		{name: "not whole microseconds", content: "rate:\n  delay: 1500ns\n", err: "MSG_UNIFORM_DELAY_US"},
+		{name: "not a duration", content: "warmup: 5\n", err: "WARMUP_MS"},
+		{name: "option set by a field", content: "duration: 1s\noptions:\n  TEST_DURATION: 5000\n", err: "TEST_DURATION"},
+		{name: "option set by the topic", content: "topic: orders\noptions:\n  TOPIC_NAME: other\n", err: "TOPIC_NAME"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keepEnv(t, scenarioKeys...)
+			s, err := loadScenario(writeScenario(t, "scenario.yaml", test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.apply()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want one about %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range test.want {
+				if got := os.Getenv(key); got != value {
+					t.Errorf("%s=%q, want %q", key, got, value)
+				}
+			}
+		})
+	}
+}